@@ -0,0 +1,324 @@
+package gocd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liumingmin/gojenkins"
+	"github.com/liumingmin/goutils/log"
+)
+
+//同一服务同一节点已有部署时的处理方式
+const (
+	DEPLOY_LOCK_NONE      = 0 // 不加锁，同一服务可同时部署到节点的多个执行器，默认
+	DEPLOY_LOCK_REJECT    = 1 // 返回ErrDeployLocked
+	DEPLOY_LOCK_WAIT      = 2 // 等待已有部署完成，等待时间同CdServerSlotWaitOption
+	DEPLOY_LOCK_SUPERSEDE = 3 // 取消已有部署
+)
+
+//获取锁后到job进入队列前，job不是繁忙状态，此时间内不认为锁过期
+const deployLockGracePeriod = 30 * time.Second
+
+//部署锁，key为env/service/node，owner为持有者标识
+//查询部署结果时发现构建已结束则释放锁，未查询时后续部署检查持有者job已空闲则接管，因此进程退出也不会死锁
+//分布式部署时使用redis、etcd等实现此接口
+type DeployLock interface {
+	Acquire(ctx context.Context, key, owner string) (bool, error) // 锁空闲时获取成功
+	Owner(ctx context.Context, key string) (string, error)        // 锁空闲时返回空
+	Release(ctx context.Context, key, owner string) error         // owner不一致时不释放
+}
+
+type memDeployLock struct {
+	mutex  sync.Mutex
+	owners map[string]string
+}
+
+//进程内锁，只能防止同一进程内的并发部署
+func NewMemDeployLock() DeployLock {
+	return &memDeployLock{owners: make(map[string]string)}
+}
+
+func (l *memDeployLock) Acquire(ctx context.Context, key, owner string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.owners[key]; ok {
+		return false, nil
+	}
+	l.owners[key] = owner
+	return true, nil
+}
+
+func (l *memDeployLock) Owner(ctx context.Context, key string) (string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.owners[key], nil
+}
+
+func (l *memDeployLock) Release(ctx context.Context, key, owner string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.owners[key] == owner {
+		delete(l.owners, key)
+	}
+	return nil
+}
+
+type fileDeployLock struct {
+	dir string
+}
+
+//文件锁，dir下每个key一个锁文件，同一机器(或共享目录)上的多个进程可共用
+func NewFileDeployLock(dir string) DeployLock {
+	return &fileDeployLock{dir: dir}
+}
+
+func (l *fileDeployLock) lockFile(key string) string {
+	return filepath.Join(l.dir, url.PathEscape(key)+".lock")
+}
+
+func (l *fileDeployLock) Acquire(ctx context.Context, key, owner string) (bool, error) {
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return false, err
+	}
+
+	file, err := os.OpenFile(l.lockFile(key), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(owner)
+	return err == nil, err
+}
+
+func (l *fileDeployLock) Owner(ctx context.Context, key string) (string, error) {
+	data, err := ioutil.ReadFile(l.lockFile(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (l *fileDeployLock) Release(ctx context.Context, key, owner string) error {
+	current, err := l.Owner(ctx, key)
+	if err != nil || current != owner {
+		return err
+	}
+
+	err = os.Remove(l.lockFile(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (j *CdServer) getDeployLockKey(service CdService, node *CdNode) string {
+	return strings.Join([]string{j.env, service.GetName(), node.GetName()}, "/")
+}
+
+//owner格式: jobFullName|获取时间
+func formatDeployLockOwner(jobFullName string, lockTime time.Time) string {
+	return fmt.Sprintf("%v|%v", jobFullName, lockTime.Unix())
+}
+
+func parseDeployLockOwner(owner string) (string, time.Time) {
+	idx := strings.LastIndex(owner, "|")
+	if idx < 0 {
+		return owner, time.Time{}
+	}
+
+	lockTime, _ := strconv.ParseInt(owner[idx+1:], 10, 64)
+	return owner[:idx], time.Unix(lockTime, 0)
+}
+
+//获取部署锁，返回的owner用于调用失败时释放，不加锁时返回空
+//查询状态不加锁，部署以外的操作不取消已有部署，supersede模式下按wait处理
+func (j *CdServer) lockDeploy(ctx context.Context, service CdService, node *CdNode, jobFullName, action string) (string, error) {
+	lockMode := j.deployLockMode
+	if lockMode == DEPLOY_LOCK_NONE || action == ACTION_STATUS {
+		return "", nil
+	}
+	if lockMode == DEPLOY_LOCK_SUPERSEDE && action != ACTION_DEPLOY {
+		lockMode = DEPLOY_LOCK_WAIT
+	}
+
+	key := j.getDeployLockKey(service, node)
+	owner := formatDeployLockOwner(jobFullName, time.Now())
+
+	deadline := time.Now().Add(j.slotWaitTimeout)
+	for {
+		ok, err := j.deployLock.Acquire(ctx, key, owner)
+		if err != nil {
+			log.Error(ctx, "acquire deploy lock failed: %v, err: %v", key, err)
+			return "", err
+		}
+		if ok {
+			return owner, nil
+		}
+
+		current, err := j.deployLock.Owner(ctx, key)
+		if err != nil {
+			log.Error(ctx, "get deploy lock owner failed: %v, err: %v", key, err)
+			return "", err
+		}
+
+		currentJob, busy, err := j.isDeployLockAlive(ctx, current)
+		if err != nil {
+			return "", err
+		}
+
+		if busy && lockMode == DEPLOY_LOCK_SUPERSEDE && currentJob != nil {
+			log.Warn(ctx, "supersede deploy: %v, owner: %v", key, current)
+			if err = j.stopJob(ctx, currentJob); err != nil {
+				return "", err
+			}
+			busy = false
+		}
+
+		if !busy {
+			//接管过期锁，其他进程同时接管时下一轮重新检查
+			if err = j.deployLock.Release(ctx, key, current); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		//supersede模式下锁刚被获取时等待持有者job进入队列
+		if lockMode == DEPLOY_LOCK_REJECT || time.Now().After(deadline) {
+			return "", fmt.Errorf("%w: %v, owner: %v", ErrDeployLocked, key, current)
+		}
+
+		log.Debug(ctx, "wait deploy lock: %v, owner: %v", key, current)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(j.slotWaitInterval):
+		}
+	}
+}
+
+func (j *CdServer) unlockDeploy(ctx context.Context, service CdService, node *CdNode, owner string) {
+	if owner == "" {
+		return
+	}
+
+	key := j.getDeployLockKey(service, node)
+	if err := j.deployLock.Release(ctx, key, owner); err != nil {
+		log.Error(ctx, "release deploy lock failed: %v, err: %v", key, err)
+	}
+}
+
+//构建结束后释放此构建持有的部署锁
+//锁在构建进入队列前获取，获取时间早于构建开始时间的锁才属于此构建，之后获取的锁属于下一次部署
+func (j *CdServer) releaseFinishedDeployLock(ctx context.Context, jobFullName string, result *DeployResult) {
+	if j.deployLockMode == DEPLOY_LOCK_NONE || result.StartedAt.IsZero() ||
+		result.Status == RUN_STATUS_QUEUED || result.Status == RUN_STATUS_RUNNING {
+		return
+	}
+
+	name, _ := splitJobFullName(jobFullName)
+	jobName, err := ParseCdJobName(name, j.env, j.nodeBroker.getNodeNames())
+	if err != nil {
+		return
+	}
+
+	key := strings.Join([]string{j.env, jobName.Service, jobName.Node}, "/")
+	owner, err := j.deployLock.Owner(ctx, key)
+	if err != nil || owner == "" {
+		return
+	}
+
+	ownerJob, lockTime := parseDeployLockOwner(owner)
+	if ownerJob != jobFullName || !lockTime.Before(result.StartedAt.Truncate(time.Second)) {
+		return
+	}
+	if err = j.deployLock.Release(ctx, key, owner); err != nil {
+		log.Error(ctx, "release deploy lock failed: %v, err: %v", key, err)
+		return
+	}
+	log.Info(ctx, "release deploy lock: %v, owner: %v", key, owner)
+}
+
+//持有者job排队或运行中，或刚获取锁还未进入队列时，锁有效
+func (j *CdServer) isDeployLockAlive(ctx context.Context, owner string) (*gojenkins.Job, bool, error) {
+	if owner == "" {
+		return nil, false, nil
+	}
+
+	jobFullName, lockTime := parseDeployLockOwner(owner)
+	if time.Since(lockTime) < deployLockGracePeriod {
+		return nil, true, nil
+	}
+
+	job, err := j.getJobByFullName(ctx, jobFullName)
+	if err != nil || job == nil {
+		//job已删除
+		return nil, false, nil
+	}
+	return job, isJobBusy(job), nil
+}
+
+//取消job排队中的构建并停止正在运行的构建
+func (j *CdServer) stopJob(ctx context.Context, job *gojenkins.Job) error {
+	queue, err := j.jenkins.GetQueue(ctx)
+	if err != nil {
+		log.Error(ctx, "GetQueue failed, err: %v", err)
+		return err
+	}
+
+	for _, item := range queue.Raw.Items {
+		if item.Task.URL != job.Raw.URL {
+			continue
+		}
+		if err = j.cancelQueueItem(ctx, item.ID); err != nil {
+			return err
+		}
+	}
+
+	if job.Raw.LastBuild.Number > 0 && job.Raw.LastBuild.Number != job.Raw.LastCompletedBuild.Number {
+		build, err := job.GetBuild(ctx, job.Raw.LastBuild.Number)
+		if err != nil {
+			log.Error(ctx, "GetBuild failed: %v, err: %v", job.Raw.LastBuild.Number, err)
+			return err
+		}
+		if err = cancelBuild(ctx, build); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//标记构建为gocd取消后停止构建，部署结果为RUN_STATUS_CANCELLED
+func cancelBuild(ctx context.Context, build *gojenkins.Build) error {
+	description := deployCancelledMarker
+	if build.Raw.Description != nil && fmt.Sprint(build.Raw.Description) != "" {
+		description = fmt.Sprint(build.Raw.Description) + " " + deployCancelledMarker
+	}
+	if err := build.SetDescription(ctx, description); err != nil {
+		log.Error(ctx, "set build description failed: %v, err: %v", build.GetUrl(), err)
+		return err
+	}
+
+	if _, err := build.Stop(ctx); err != nil {
+		log.Error(ctx, "stop build failed: %v, err: %v", build.GetUrl(), err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package gocd
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//部署脚本输出的标记行
+//gocd:stage:<name>:<开始时间ms>
+//gocd:exit:<退出码>:<结束时间ms>
+//gocd:fail:<失败码>:<详情>
+//gocd:status:<running|stopped|unknown>:<详情>
+const (
+	stageLinePrefix  = "gocd:stage:"
+	exitLinePrefix   = "gocd:exit:"
+	failLinePrefix   = "gocd:fail:"
+	statusLinePrefix = "gocd:status:"
+)
+
+const (
+	SERVICE_STATE_RUNNING = "running"
+	SERVICE_STATE_STOPPED = "stopped"
+	SERVICE_STATE_UNKNOWN = "unknown"
+)
+
+//status操作输出的服务状态
+type CdServiceStatus struct {
+	NodeName string
+	State    string // SERVICE_STATE_*
+	Detail   string
+}
+
+type DeployStage struct {
+	Name      string
+	StartedAt time.Time
+	Duration  time.Duration // 未结束时为0
+	Finished  bool
+	Status    string // 仅pipeline，jenkins stage状态: SUCCESS FAILED ABORTED IN_PROGRESS等
+}
+
+type cdDeployMarkers struct {
+	stages     []*DeployStage
+	exitCode   int // 脚本未输出时为-1
+	finishedAt time.Time
+	failCode   string
+	failDetail string
+	status     *CdServiceStatus
+}
+
+func parseDeployMarkers(consoleOutput string) *cdDeployMarkers {
+	markers := &cdDeployMarkers{exitCode: -1}
+
+	scanner := bufio.NewScanner(strings.NewReader(consoleOutput))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, stageLinePrefix) {
+			fields := strings.Split(line[len(stageLinePrefix):], ":")
+			if len(fields) != 2 || fields[0] == "" {
+				continue
+			}
+			startedAt, ok := parseMarkerTime(fields[1])
+			if !ok {
+				continue
+			}
+
+			markers.finishStage(startedAt)
+			markers.stages = append(markers.stages, &DeployStage{Name: fields[0], StartedAt: startedAt})
+		} else if strings.HasPrefix(line, statusLinePrefix) {
+			fields := strings.SplitN(line[len(statusLinePrefix):], ":", 2)
+			markers.status = &CdServiceStatus{State: fields[0]}
+			if len(fields) == 2 {
+				markers.status.Detail = strings.TrimSpace(fields[1])
+			}
+		} else if strings.HasPrefix(line, failLinePrefix) {
+			fields := strings.SplitN(line[len(failLinePrefix):], ":", 2)
+			markers.failCode = fields[0]
+			if len(fields) == 2 {
+				markers.failDetail = fields[1]
+			}
+		} else if strings.HasPrefix(line, exitLinePrefix) {
+			fields := strings.Split(line[len(exitLinePrefix):], ":")
+			if len(fields) != 2 {
+				continue
+			}
+			exitCode, err := strconv.Atoi(fields[0])
+			if err != nil {
+				continue
+			}
+			finishedAt, ok := parseMarkerTime(fields[1])
+			if !ok {
+				continue
+			}
+
+			markers.exitCode = exitCode
+			markers.finishedAt = finishedAt
+			//失败退出时最后一个阶段未完成
+			if exitCode == 0 {
+				markers.finishStage(finishedAt)
+			} else if len(markers.stages) > 0 {
+				stage := markers.stages[len(markers.stages)-1]
+				stage.Duration = finishedAt.Sub(stage.StartedAt)
+			}
+		}
+	}
+	return markers
+}
+
+//上一阶段在下一阶段开始时结束
+func (m *cdDeployMarkers) finishStage(endAt time.Time) {
+	if len(m.stages) == 0 {
+		return
+	}
+
+	stage := m.stages[len(m.stages)-1]
+	if stage.Finished {
+		return
+	}
+	stage.Duration = endAt.Sub(stage.StartedAt)
+	stage.Finished = true
+}
+
+func parseMarkerTime(ms string) (time.Time, bool) {
+	msInt, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, msInt*int64(time.Millisecond)), true
+}
+
+func msToTime(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
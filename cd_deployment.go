@@ -0,0 +1,335 @@
+package gocd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liumingmin/gojenkins"
+	"github.com/liumingmin/goutils/log"
+)
+
+//Wait和Logs轮询jenkins的间隔
+const deployPollInterval = 2 * time.Second
+
+//一次部署的句柄，ID可保存后在其他进程中通过CdServer.LoadDeployment恢复
+type Deployment struct {
+	server   *CdServer
+	jobName  string // job全路径名
+	taskId   int64  // jenkins队列id
+	deployId string // GOCD_DEPLOY_ID参数，队列项过期后用于查找构建
+	nodeName string
+}
+
+//ID格式: jobFullName#taskId#deployId
+func (d *Deployment) ID() string {
+	if d.deployId == "" {
+		return formatBuildKey(d.jobName, d.taskId)
+	}
+	return fmt.Sprintf("%v#%v#%v", d.jobName, d.taskId, d.deployId)
+}
+
+func (d *Deployment) JobName() string {
+	return d.jobName
+}
+
+func (d *Deployment) TaskId() int64 {
+	return d.taskId
+}
+
+func (d *Deployment) DeployId() string {
+	return d.deployId
+}
+
+//LoadDeployment恢复的句柄在构建开始前为空
+func (d *Deployment) NodeName() string {
+	return d.nodeName
+}
+
+func (d *Deployment) Status(ctx context.Context) (*DeployResult, error) {
+	ctx = withDeployIdCtx(ctx, d.deployId)
+	result, err := d.server.getDeployResult(ctx, d.jobName, d.taskId, d.deployId)
+	if err != nil {
+		return nil, err
+	}
+	if result.NodeName != "" {
+		d.nodeName = result.NodeName
+	}
+	return result, nil
+}
+
+//等待部署结束，部署失败时返回result.Err()
+func (d *Deployment) Wait(ctx context.Context) (*DeployResult, error) {
+	ctx = withDeployIdCtx(ctx, d.deployId)
+	for {
+		result, err := d.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if result.Status != RUN_STATUS_QUEUED && result.Status != RUN_STATUS_RUNNING {
+			return result, result.Err()
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(deployPollInterval):
+		}
+	}
+}
+
+//持续输出构建日志到w，直到构建结束
+func (d *Deployment) Logs(ctx context.Context, w io.Writer) error {
+	ctx = withDeployIdCtx(ctx, d.deployId)
+	build, err := d.waitBuild(ctx)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for {
+		console, err := build.GetConsoleOutputFromIndex(ctx, offset)
+		if err != nil {
+			log.Error(ctx, "get console output failed: %v, err: %v", d.ID(), err)
+			return err
+		}
+		if _, err = io.WriteString(w, console.Content); err != nil {
+			return err
+		}
+		offset = console.Offset
+		if !console.HasMoreText {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(deployPollInterval):
+		}
+	}
+}
+
+func (d *Deployment) Cancel(ctx context.Context) error {
+	ctx = withDeployIdCtx(ctx, d.deployId)
+	return d.server.CancelDeploy(ctx, d.jobName, d.taskId)
+}
+
+//等待任务离开队列开始构建，ctx结束时仍在排队返回ErrQueueTimeout
+func (d *Deployment) waitBuild(ctx context.Context) (*gojenkins.Build, error) {
+	for {
+		item, err := d.server.resolveBuild(ctx, d.jobName, d.taskId, d.deployId)
+		if err != nil {
+			return nil, err
+		}
+		if item.Cancelled {
+			return nil, ErrDeployCancelled
+		}
+
+		if item.Executable.Number > 0 {
+			job, err := d.server.getJobByFullName(ctx, d.jobName)
+			if err != nil {
+				return nil, err
+			}
+			build, err := job.GetBuild(ctx, item.Executable.Number)
+			if err != nil {
+				return nil, err
+			}
+			setBuildDeployId(ctx, build)
+			return build, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v, %v", ErrQueueTimeout, d.ID(), ctx.Err())
+		case <-time.After(deployPollInterval):
+		}
+	}
+}
+
+//从Deployment.ID()恢复部署句柄，兼容没有deployId的jobFullName#taskId
+func (j *CdServer) LoadDeployment(id string) (*Deployment, error) {
+	fields := strings.Split(id, "#")
+	if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+		return nil, fmt.Errorf("invalid deployment id: %v", id)
+	}
+
+	taskId, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || taskId <= 0 {
+		return nil, fmt.Errorf("invalid deployment id: %v", id)
+	}
+
+	deployment := &Deployment{server: j, jobName: fields[0], taskId: taskId}
+	if len(fields) == 3 {
+		deployment.deployId = fields[2]
+	}
+	return deployment, nil
+}
+
+func (j *CdServer) Deploy(ctx context.Context, service CdService, nodeName string) (*Deployment, error) {
+	node := j.nodeBroker.GetNodeByName(nodeName)
+	if node == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNodeNotFound, nodeName)
+	}
+
+	return j.RunAction(ctx, service, nodeName, ACTION_DEPLOY)
+}
+
+//在节点上执行服务操作(ACTION_*)，使用与部署相同的job和执行器
+func (j *CdServer) RunAction(ctx context.Context, service CdService, nodeName, action string) (*Deployment, error) {
+	return j.runAction(ctx, service, nodeName, action, nil)
+}
+
+//actionParams覆盖服务参数，如回滚目标版本
+func (j *CdServer) runAction(ctx context.Context, service CdService, nodeName, action string, actionParams map[string]string) (*Deployment, error) {
+	if !isValidAction(action) {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedAction, action)
+	}
+
+	node := j.nodeBroker.GetNodeByName(nodeName)
+	if node == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNodeNotFound, nodeName)
+	}
+
+	deployId := NewDeployId()
+	jobName, taskId, err := j.deploy(ctx, service, node, deployId, action, actionParams)
+	if err != nil {
+		return nil, err
+	}
+	return &Deployment{server: j, jobName: jobName, taskId: taskId, deployId: deployId, nodeName: nodeName}, nil
+}
+
+func (j *CdServer) Start(ctx context.Context, service CdService, nodeName string) (*DeployResult, error) {
+	return j.runActionAndWait(ctx, service, nodeName, ACTION_START)
+}
+
+//节点临时下线(维护窗口)时jenkins不在节点上开始构建，先临时上线执行停止，完成后恢复下线
+//上线期间jenkins会开始该节点上排队的所有构建(包括其他服务和其他工具的job)，本进程只能拒绝自己的部署
+//因此节点有排队中的构建时拒绝停止，返回ErrNodeDisabled，检查后到上线前新进入队列的构建仍可能被执行
+func (j *CdServer) Stop(ctx context.Context, service CdService, nodeName string) (*DeployResult, error) {
+	node := j.nodeBroker.GetNodeByName(nodeName)
+	if node == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNodeNotFound, nodeName)
+	}
+
+	disabled, err := node.IsTemporarilyOffline(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !disabled {
+		return j.runActionAndWait(ctx, service, nodeName, ACTION_STOP)
+	}
+
+	reason := node.Raw.OfflineCauseReason
+	j.stoppingNodes.Store(nodeName, true)
+	defer j.stoppingNodes.Delete(nodeName)
+
+	queuedTasks, err := j.getNodeQueuedTasks(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	if len(queuedTasks) > 0 {
+		log.Error(ctx, "stop refused, disabled node has queued builds: %v, tasks: %v", nodeName, queuedTasks)
+		return nil, fmt.Errorf("%w: %v has queued builds: %v", ErrNodeDisabled, nodeName, strings.Join(queuedTasks, ","))
+	}
+
+	if err = j.nodeBroker.EnableNode(ctx, nodeName); err != nil {
+		return nil, err
+	}
+	defer func() {
+		//ctx已取消时也要恢复下线
+		restoreCtx := context.WithValue(context.Background(), log.LOG_TRADE_ID, ctx.Value(log.LOG_TRADE_ID))
+		if err := j.nodeBroker.DisableNode(restoreCtx, nodeName, reason); err != nil {
+			log.Error(restoreCtx, "restore node disabled failed: %v, err: %v", nodeName, err)
+		}
+	}()
+
+	log.Info(ctx, "stop on disabled node: %v, reason: %v", nodeName, reason)
+	return j.runActionAndWait(ctx, service, nodeName, ACTION_STOP)
+}
+
+//返回队列中等待该节点的任务名，gocd job名称中包含节点名，其他job按排队原因中的节点名(标签)判断
+func (j *CdServer) getNodeQueuedTasks(ctx context.Context, nodeName string) ([]string, error) {
+	queue, err := j.jenkins.GetQueue(ctx)
+	if err != nil {
+		log.Error(ctx, "GetQueue failed, err: %v", err)
+		return nil, err
+	}
+
+	tasks := make([]string, 0)
+	for _, item := range queue.Raw.Items {
+		if isNodeQueueItem(item.Task.Name, item.Why, nodeName) {
+			tasks = append(tasks, item.Task.Name)
+		}
+	}
+	return tasks, nil
+}
+
+func isNodeQueueItem(taskName, why, nodeName string) bool {
+	return strings.Contains(taskName, "-"+nodeName+"-") || strings.Contains(why, nodeName)
+}
+
+func (j *CdServer) Restart(ctx context.Context, service CdService, nodeName string) (*DeployResult, error) {
+	return j.runActionAndWait(ctx, service, nodeName, ACTION_RESTART)
+}
+
+//将节点上的服务切换回release版本(TARGET_PATH/releases下的目录名，即部署id)后重启，不重新下载程序包
+//release为空时回滚到当前版本的上一个版本，版本不存在时返回ErrReleaseNotFound
+func (j *CdServer) Rollback(ctx context.Context, service CdService, nodeName, release string) (*DeployResult, error) {
+	deployment, err := j.runAction(ctx, service, nodeName, ACTION_ROLLBACK, map[string]string{rollbackParamName: release})
+	if err != nil {
+		return nil, err
+	}
+	return deployment.Wait(ctx)
+}
+
+//查询服务在节点上的运行状态
+func (j *CdServer) Status(ctx context.Context, service CdService, nodeName string) (*CdServiceStatus, error) {
+	result, err := j.runActionAndWait(ctx, service, nodeName, ACTION_STATUS)
+	if err != nil {
+		return nil, err
+	}
+	if result.ServiceStatus == nil {
+		return &CdServiceStatus{NodeName: nodeName, State: SERVICE_STATE_UNKNOWN}, nil
+	}
+	return result.ServiceStatus, nil
+}
+
+func (j *CdServer) runActionAndWait(ctx context.Context, service CdService, nodeName, action string) (*DeployResult, error) {
+	deployment, err := j.RunAction(ctx, service, nodeName, action)
+	if err != nil {
+		return nil, err
+	}
+	return deployment.Wait(ctx)
+}
+
+func isValidAction(action string) bool {
+	return containsString(allActions, action)
+}
+
+//日志trace id中追加部署id，已有trace id时保留
+func withDeployIdCtx(ctx context.Context, deployId string) context.Context {
+	if deployId == "" {
+		return ctx
+	}
+
+	traceId := ctx.Value(log.LOG_TRADE_ID)
+	if traceId == nil {
+		return context.WithValue(ctx, log.LOG_TRADE_ID, deployId)
+	}
+	if strings.HasSuffix(fmt.Sprint(traceId), deployId) {
+		return ctx
+	}
+	return context.WithValue(ctx, log.LOG_TRADE_ID, fmt.Sprintf("%v,%v", traceId, deployId))
+}
+
+//时间+随机数，同一时刻多个进程部署也不重复，可传给DeploySimpleWithId
+func NewDeployId() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(buf)
+}
@@ -0,0 +1,78 @@
+package gocd
+
+import (
+	"errors"
+	"fmt"
+)
+
+//部署错误分类，使用errors.Is判断，脚本失败详情使用errors.As获取*DeployError
+var (
+	ErrNodeNotFound    = errors.New("node not found")
+	ErrNodeDisabled    = errors.New("node disabled")
+	ErrNodeOffline     = errors.New("node offline")
+	ErrJobCreate       = errors.New("create job failed")
+	ErrQueueTimeout    = errors.New("queue timeout")
+	ErrBuildNotFound   = errors.New("build not found")
+	ErrDeployLocked    = errors.New("deploy locked")
+	ErrDeployCancelled = errors.New("deploy cancelled") // 通过CancelDeploy取消
+	ErrDeployAborted   = errors.New("deploy aborted")   // 被jenkins中止，如构建超时
+	ErrDeployFailed    = errors.New("deploy failed")    // 脚本失败但未输出失败码
+	ErrPackageDownload = errors.New("package download failed")
+	ErrRunCmdFailed    = errors.New("run cmd failed")
+	ErrHealthCheck     = errors.New("health check failed")
+	ErrHookFailed      = errors.New("hook failed")       // 程序包中的钩子脚本失败，DeployError.Detail为钩子名称
+	ErrReleaseNotFound = errors.New("release not found") // 回滚目标版本不存在
+
+	ErrUnsupportedAction = errors.New("unsupported action")
+	ErrInvalidParam      = errors.New("invalid param")
+	ErrInvalidScript     = errors.New("invalid script")
+)
+
+//脚本失败码，脚本输出 gocd:fail:<code>:<detail>
+const (
+	FAIL_CODE_PACKAGE_DOWNLOAD  = "PACKAGE_DOWNLOAD"
+	FAIL_CODE_RUN_CMD_FAILED    = "RUN_CMD_FAILED"
+	FAIL_CODE_HEALTH_CHECK      = "HEALTH_CHECK"
+	FAIL_CODE_HOOK_FAILED       = "HOOK_FAILED"
+	FAIL_CODE_RELEASE_NOT_FOUND = "RELEASE_NOT_FOUND"
+
+	FAIL_CODE_UNSUPPORTED_ACTION = "UNSUPPORTED_ACTION"
+	FAIL_CODE_INVALID_TARGET     = "INVALID_TARGET" // TARGET_PATH不是gocd部署的目录
+)
+
+var failCodeErrors = map[string]error{
+	FAIL_CODE_PACKAGE_DOWNLOAD:  ErrPackageDownload,
+	FAIL_CODE_RUN_CMD_FAILED:    ErrRunCmdFailed,
+	FAIL_CODE_HEALTH_CHECK:      ErrHealthCheck,
+	FAIL_CODE_HOOK_FAILED:       ErrHookFailed,
+	FAIL_CODE_RELEASE_NOT_FOUND: ErrReleaseNotFound,
+
+	FAIL_CODE_UNSUPPORTED_ACTION: ErrUnsupportedAction,
+	FAIL_CODE_INVALID_TARGET:     ErrInvalidParam,
+}
+
+//部署脚本执行失败
+type DeployError struct {
+	Code     string // 脚本输出的失败码
+	Detail   string
+	ExitCode int
+	Err      error // 对应的错误分类
+}
+
+func (e *DeployError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%v, exit code: %v", e.Err, e.ExitCode)
+	}
+	return fmt.Sprintf("%v: %v %v, exit code: %v", e.Err, e.Code, e.Detail, e.ExitCode)
+}
+
+func (e *DeployError) Unwrap() error {
+	return e.Err
+}
+
+func getFailCodeError(code string) error {
+	if err, ok := failCodeErrors[code]; ok {
+		return err
+	}
+	return ErrDeployFailed
+}
@@ -0,0 +1,380 @@
+package gocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/liumingmin/gojenkins"
+	"github.com/liumingmin/goutils/log"
+)
+
+const (
+	JOB_GC_REASON_NODE_DELETED     = "node deleted"
+	JOB_GC_REASON_EXECUTOR_REMOVED = "executor removed"
+	JOB_GC_REASON_VERSION_OBSOLETE = "script version obsolete"
+	JOB_GC_REASON_SERVICE_RETIRED  = "service retired"
+)
+
+//推荐的job目录，默认不使用目录(兼容旧版本)，启用后使用JobManager.MigrateRootJobs迁移根目录下的旧job
+const DEFAULT_JOB_FOLDER = "gocd"
+
+//gocd创建的jenkins job名称: scriptVersion-env-service-node-idx
+type CdJobName struct {
+	Name          string
+	Parents       []string // 所在目录
+	ScriptVersion int
+	Env           string
+	Service       string
+	Node          string
+	Idx           int64
+}
+
+func (n *CdJobName) FullName() string {
+	return formatJobFullName(n.Name, n.Parents)
+}
+
+func formatJobFullName(jobName string, parents []string) string {
+	return strings.Join(append(append([]string{}, parents...), jobName), "/")
+}
+
+func splitJobFullName(jobFullName string) (string, []string) {
+	paths := strings.Split(strings.Trim(jobFullName, "/"), "/")
+	return paths[len(paths)-1], paths[:len(paths)-1]
+}
+
+func formatJobName(scriptVersion int, env, service, node string, idx int64) string {
+	return fmt.Sprintf("%v-%v-%v-%v-%v", scriptVersion, env, service, node, idx)
+}
+
+//service和node名称中都可能有'-'，优先按已知节点名切分，否则以最后一个'-'切分
+func ParseCdJobName(name, env string, nodeNames []string) (*CdJobName, error) {
+	errInvalid := fmt.Errorf("not gocd job name: %v", name)
+
+	idx := strings.Index(name, "-")
+	if idx <= 0 {
+		return nil, errInvalid
+	}
+	scriptVersion, err := strconv.Atoi(name[:idx])
+	if err != nil {
+		return nil, errInvalid
+	}
+
+	rest := name[idx+1:]
+	if !strings.HasPrefix(rest, env+"-") {
+		return nil, errInvalid
+	}
+	rest = rest[len(env)+1:]
+
+	idx = strings.LastIndex(rest, "-")
+	if idx <= 0 {
+		return nil, errInvalid
+	}
+	jobIdx, err := strconv.ParseInt(rest[idx+1:], 10, 64)
+	if err != nil {
+		return nil, errInvalid
+	}
+	rest = rest[:idx]
+
+	service, node := "", ""
+	for _, nodeName := range nodeNames {
+		if strings.HasSuffix(rest, "-"+nodeName) && len(nodeName) > len(node) && len(rest) > len(nodeName)+1 {
+			service, node = rest[:len(rest)-len(nodeName)-1], nodeName
+		}
+	}
+	if node == "" {
+		idx = strings.LastIndex(rest, "-")
+		if idx <= 0 || idx == len(rest)-1 {
+			return nil, errInvalid
+		}
+		service, node = rest[:idx], rest[idx+1:]
+	}
+
+	return &CdJobName{
+		Name:          name,
+		ScriptVersion: scriptVersion,
+		Env:           env,
+		Service:       service,
+		Node:          node,
+		Idx:           jobIdx,
+	}, nil
+}
+
+type CdJobGcItem struct {
+	Job    *CdJobName
+	Reason string
+	Err    error
+}
+
+type cdJobGcParam struct {
+	dryRun bool
+}
+
+type CdJobGcOption func(*cdJobGcParam)
+
+func CdJobGcDryRunOption() CdJobGcOption {
+	return func(param *cdJobGcParam) {
+		param.dryRun = true
+	}
+}
+
+type JobManager struct {
+	server *CdServer
+}
+
+func (j *CdServer) GetJobManager() *JobManager {
+	return &JobManager{server: j}
+}
+
+//列出本环境gocd创建的job，包括jobFolder/env/service目录下的job和根目录下的旧job
+func (m *JobManager) ListJobs(ctx context.Context) ([]*CdJobName, error) {
+	innerJobs, err := m.server.jenkins.GetAllJobNames(ctx)
+	if err != nil {
+		log.Error(ctx, "ListJobs failed, err: %v", err)
+		return nil, err
+	}
+
+	nodeNames := m.server.nodeBroker.getNodeNames()
+	jobNames := make([]*CdJobName, 0)
+	for _, innerJob := range innerJobs {
+		jobName, err := ParseCdJobName(innerJob.Name, m.server.env, nodeNames)
+		if err != nil {
+			continue
+		}
+		jobNames = append(jobNames, jobName)
+	}
+
+	if m.server.jobFolder != "" {
+		folderJobNames, err := m.listFolderJobs(ctx, nodeNames)
+		if err != nil {
+			log.Error(ctx, "ListJobs in folder failed, err: %v", err)
+			return nil, err
+		}
+		jobNames = append(jobNames, folderJobNames...)
+	}
+
+	sort.Slice(jobNames, func(i, j int) bool {
+		return jobNames[i].FullName() < jobNames[j].FullName()
+	})
+	return jobNames, nil
+}
+
+func (m *JobManager) listFolderJobs(ctx context.Context, nodeNames []string) ([]*CdJobName, error) {
+	jobNames := make([]*CdJobName, 0)
+	envFolder, err := m.server.jenkins.GetFolder(ctx, m.server.env, m.server.jobFolder)
+	if err != nil {
+		//目录不存在
+		return jobNames, nil
+	}
+
+	for _, serviceFolder := range envFolder.Raw.Jobs {
+		parents := []string{m.server.jobFolder, m.server.env, serviceFolder.Name}
+		folder, err := m.server.jenkins.GetFolder(ctx, serviceFolder.Name, parents[:2]...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, innerJob := range folder.Raw.Jobs {
+			jobName, err := ParseCdJobName(innerJob.Name, m.server.env, nodeNames)
+			if err != nil {
+				continue
+			}
+			jobName.Parents = parents
+			jobNames = append(jobNames, jobName)
+		}
+	}
+	return jobNames, nil
+}
+
+//将根目录下的旧job移动到jobFolder/env/service目录，保留构建历史
+func (m *JobManager) MigrateRootJobs(ctx context.Context, dryRun bool) ([]*CdJobName, error) {
+	if m.server.jobFolder == "" {
+		return nil, errors.New("job folder disabled")
+	}
+
+	jobNames, err := m.ListJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := make([]*CdJobName, 0)
+	for _, jobName := range jobNames {
+		if len(jobName.Parents) > 0 {
+			continue
+		}
+
+		job, err := m.server.jenkins.GetJob(ctx, jobName.Name)
+		if err != nil {
+			log.Error(ctx, "MigrateRootJobs get job failed: %v, err: %v", jobName.Name, err)
+			return migrated, err
+		}
+		if !m.isCdJob(jobName, job) {
+			log.Info(ctx, "MigrateRootJobs skip job not created by gocd: %v", jobName.Name)
+			continue
+		}
+
+		parents := m.server.getJobParents(jobName.Service)
+		if !dryRun {
+			if err = m.server.ensureJobFolders(ctx, parents); err != nil {
+				return migrated, err
+			}
+
+			qr := map[string]string{"destination": "/" + strings.Join(parents, "/")}
+			resp, err := m.server.jenkins.Requester.Post(ctx, "/job/"+jobName.Name+"/move/move", nil, nil, qr)
+			if err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("move job status: %v", resp.StatusCode)
+			}
+			if err != nil {
+				log.Error(ctx, "MigrateRootJobs move failed: %v, err: %v", jobName.Name, err)
+				return migrated, err
+			}
+		}
+
+		log.Info(ctx, "MigrateRootJobs: %v -> %v, dryRun: %v", jobName.Name, parents, dryRun)
+		jobName.Parents = parents
+		migrated = append(migrated, jobName)
+	}
+	return migrated, nil
+}
+
+//清理已删除节点、已减少的执行器、过期脚本版本和已下线服务的job
+//services为当前在用的全部服务，为空时不检查脚本版本和服务
+func (m *JobManager) GC(ctx context.Context, services []CdService, options ...CdJobGcOption) ([]*CdJobGcItem, error) {
+	gcParam := &cdJobGcParam{}
+	for _, option := range options {
+		option(gcParam)
+	}
+
+	if err := m.server.nodeBroker.UpdateNodeCache(ctx); err != nil {
+		return nil, err
+	}
+
+	jobNames, err := m.ListJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceVersions := make(map[string]int)
+	for _, service := range services {
+		serviceVersions[service.GetName()] = service.GetCdScript().scriptVersion
+	}
+
+	items := make([]*CdJobGcItem, 0)
+	for _, jobName := range jobNames {
+		reason := m.getGcReason(jobName, services, serviceVersions)
+		if reason == "" {
+			continue
+		}
+
+		job, err := m.server.jenkins.GetJob(ctx, jobName.Name, jobName.Parents...)
+		if err != nil {
+			items = append(items, &CdJobGcItem{Job: jobName, Reason: reason, Err: err})
+			log.Error(ctx, "GC get job failed: %v, err: %v", jobName.FullName(), err)
+			continue
+		}
+		if !m.isCdJob(jobName, job) {
+			log.Info(ctx, "GC skip job not created by gocd: %v", jobName.FullName())
+			continue
+		}
+
+		item := &CdJobGcItem{Job: jobName, Reason: reason}
+		if !gcParam.dryRun {
+			item.Err = deleteIdleJob(ctx, jobName, job)
+		}
+		items = append(items, item)
+		log.Info(ctx, "GC job: %v, reason: %v, dryRun: %v, err: %v", jobName.FullName(), reason, gcParam.dryRun, item.Err)
+	}
+	return items, nil
+}
+
+func (m *JobManager) getGcReason(jobName *CdJobName, services []CdService, serviceVersions map[string]int) string {
+	node := m.server.nodeBroker.GetNodeByName(jobName.Node)
+	if node == nil {
+		return JOB_GC_REASON_NODE_DELETED
+	}
+	if jobName.Idx >= node.Raw.NumExecutors {
+		return JOB_GC_REASON_EXECUTOR_REMOVED
+	}
+
+	if len(services) == 0 {
+		return ""
+	}
+
+	scriptVersion, ok := serviceVersions[jobName.Service]
+	if !ok {
+		return JOB_GC_REASON_SERVICE_RETIRED
+	}
+	if scriptVersion != jobName.ScriptVersion {
+		return JOB_GC_REASON_VERSION_OBSOLETE
+	}
+	return ""
+}
+
+//job名称格式可能和其他job重名，且按环境前缀解析时prod会匹配prod-eu环境的job
+//jobFolder/env下的job，或描述中记录的环境与本环境一致的job是本环境gocd创建的
+//未记录环境的job(旧版本创建的job没有描述)，名称中的节点属于本环境且名称完全一致时才是本环境的job
+func (m *JobManager) isCdJob(jobName *CdJobName, job *gojenkins.Job) bool {
+	if len(jobName.Parents) > 0 {
+		return true
+	}
+
+	if env, ok := parseJobDescriptionEnv(job.GetDescription()); ok {
+		return env == m.server.env
+	}
+
+	node := m.server.nodeBroker.GetNodeByName(jobName.Node)
+	if node == nil || node.isMaster() {
+		return false
+	}
+	return jobName.Name == formatJobName(jobName.ScriptVersion, m.server.env, jobName.Service, node.GetName(), jobName.Idx)
+}
+
+//排队或运行中的job不删除
+func deleteIdleJob(ctx context.Context, jobName *CdJobName, job *gojenkins.Job) error {
+	if isJobBusy(job) {
+		return fmt.Errorf("job is busy: %v", jobName.FullName())
+	}
+
+	_, err := job.Delete(ctx)
+	return err
+}
+
+func (j *CdServer) getJobParents(service string) []string {
+	if j.jobFolder == "" {
+		return nil
+	}
+	return []string{j.jobFolder, j.env, service}
+}
+
+func (j *CdServer) getJobByFullName(ctx context.Context, jobFullName string) (*gojenkins.Job, error) {
+	jobName, parents := splitJobFullName(jobFullName)
+	return j.jenkins.GetJob(ctx, jobName, parents...)
+}
+
+//逐级创建不存在的目录
+func (j *CdServer) ensureJobFolders(ctx context.Context, parents []string) error {
+	for i := range parents {
+		path := strings.Join(parents[:i+1], "/")
+		if _, ok := j.createdFolder.Load(path); ok {
+			continue
+		}
+
+		if _, err := j.jenkins.GetFolder(ctx, parents[i], parents[:i]...); err != nil {
+			if _, err = j.jenkins.CreateFolder(ctx, parents[i], parents[:i]...); err != nil {
+				return err
+			}
+			log.Info(ctx, "CreateFolder ok: %v", path)
+		}
+		j.createdFolder.Store(path, true)
+	}
+	return nil
+}
+
+//排队中或最后一次构建未完成
+func isJobBusy(job *gojenkins.Job) bool {
+	return job.Raw.InQueue || (job.Raw.LastBuild.Number > 0 && job.Raw.LastBuild.Number != job.Raw.LastCompletedBuild.Number)
+}
@@ -0,0 +1,99 @@
+package gocd
+
+import (
+	"fmt"
+	"time"
+)
+
+//job构建超时和构建记录保留设置，为0时使用CdServer的设置(未设置时不限制)，小于0时不限制
+//freestyle job超时需要jenkins安装build-timeout插件，pipeline job使用timeout选项
+type CdJobOption struct {
+	Timeout            time.Duration // 构建超时，超时后中止构建，freestyle job按分钟向上取整
+	NumToKeep          int           // 保留的构建数
+	DaysToKeep         int           // 构建保留天数
+	ArtifactNumToKeep  int           // 保留制品的构建数
+	ArtifactDaysToKeep int           // 制品保留天数
+}
+
+//脚本中取消CdServer的超时或保留设置
+const JOB_OPTION_UNLIMITED = -1
+
+//hudson.tasks.LogRotator配置，-1表示不限制
+type cdLogRotator struct {
+	DaysToKeep         int
+	NumToKeep          int
+	ArtifactDaysToKeep int
+	ArtifactNumToKeep  int
+}
+
+//按顺序合并，后面option中不为0的值覆盖前面的值，小于0的值覆盖后不限制
+func mergeJobOption(options ...*CdJobOption) *CdJobOption {
+	merged := &CdJobOption{}
+	for _, option := range options {
+		if option == nil {
+			continue
+		}
+		if option.Timeout != 0 {
+			merged.Timeout = option.Timeout
+		}
+		if option.NumToKeep != 0 {
+			merged.NumToKeep = option.NumToKeep
+		}
+		if option.DaysToKeep != 0 {
+			merged.DaysToKeep = option.DaysToKeep
+		}
+		if option.ArtifactNumToKeep != 0 {
+			merged.ArtifactNumToKeep = option.ArtifactNumToKeep
+		}
+		if option.ArtifactDaysToKeep != 0 {
+			merged.ArtifactDaysToKeep = option.ArtifactDaysToKeep
+		}
+	}
+	return merged
+}
+
+func (o *CdJobOption) timeoutMinutes() int64 {
+	if o.Timeout <= 0 {
+		return 0
+	}
+	return int64((o.Timeout + time.Minute - 1) / time.Minute)
+}
+
+//pipeline options中的timeout，未设置超时时为空
+func (o *CdJobOption) pipelineTimeout() string {
+	if o.Timeout <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("timeout(time: %v, unit: 'SECONDS')", int64(o.Timeout.Seconds()))
+}
+
+//未设置任何保留值时返回nil，不生成BuildDiscarderProperty
+func (o *CdJobOption) logRotator() *cdLogRotator {
+	if o.NumToKeep <= 0 && o.DaysToKeep <= 0 && o.ArtifactNumToKeep <= 0 && o.ArtifactDaysToKeep <= 0 {
+		return nil
+	}
+	return &cdLogRotator{
+		DaysToKeep:         keepOrUnlimited(o.DaysToKeep),
+		NumToKeep:          keepOrUnlimited(o.NumToKeep),
+		ArtifactDaysToKeep: keepOrUnlimited(o.ArtifactDaysToKeep),
+		ArtifactNumToKeep:  keepOrUnlimited(o.ArtifactNumToKeep),
+	}
+}
+
+func keepOrUnlimited(value int) int {
+	if value <= 0 {
+		return -1
+	}
+	return value
+}
+
+//job配置中的构建保留设置，freestyle和pipeline job共用
+const jobLogRotatorXmlTpl = `{{with .LogRotator}}
+    <jenkins.model.BuildDiscarderProperty>
+      <strategy class="hudson.tasks.LogRotator">
+        <daysToKeep>{{.DaysToKeep}}</daysToKeep>
+        <numToKeep>{{.NumToKeep}}</numToKeep>
+        <artifactDaysToKeep>{{.ArtifactDaysToKeep}}</artifactDaysToKeep>
+        <artifactNumToKeep>{{.ArtifactNumToKeep}}</artifactNumToKeep>
+      </strategy>
+    </jenkins.model.BuildDiscarderProperty>{{end}}`
@@ -3,7 +3,9 @@ package gocd
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/liumingmin/gojenkins"
 	"github.com/liumingmin/goutils/log"
@@ -13,8 +15,9 @@ type CdNodeBroker struct {
 	jenkins        *gojenkins.Jenkins
 	env            string
 	defCdNodeParam *CdNodeParam
+	sshExecutor    CdSshExecutor
 
-	nodesCache map[string]*gojenkins.Node
+	nodesCache map[string]*CdNode
 }
 
 func NewCdNodeBroker(jenkins *gojenkins.Jenkins, env string, nodeParam *CdNodeParam) *CdNodeBroker {
@@ -22,7 +25,7 @@ func NewCdNodeBroker(jenkins *gojenkins.Jenkins, env string, nodeParam *CdNodePa
 		jenkins:        jenkins,
 		env:            env,
 		defCdNodeParam: nodeParam,
-		nodesCache:     make(map[string]*gojenkins.Node),
+		nodesCache:     make(map[string]*CdNode),
 	}
 
 	if cdNodeBroker.defCdNodeParam == nil {
@@ -39,20 +42,25 @@ func (t *CdNodeBroker) SetDefCdNodeParam(defCdNodeParam *CdNodeParam) {
 	}
 }
 
+//节点初始化使用的ssh执行器，默认使用本机ssh命令
+func (t *CdNodeBroker) SetSshExecutor(sshExecutor CdSshExecutor) {
+	t.sshExecutor = sshExecutor
+}
+
 //最好使用内网IP
 func (t *CdNodeBroker) CreateNode(ctx context.Context, ip, remark string, options ...CdNodeOption) error {
-	cdNodeInfo := t.defCdNodeParam
-	if len(options) > 0 {
-		cdNodeInfo = &CdNodeParam{}
-		*cdNodeInfo = *t.defCdNodeParam
+	cdNodeInfo := t.mergeNodeParam(options...)
 
-		for _, option := range options {
-			option(cdNodeInfo)
+	for key, value := range cdNodeInfo.labels {
+		if !isValidLabelToken(key) || !isValidLabelToken(value) {
+			return fmt.Errorf("invalid node label: %v=%v", key, value)
 		}
 	}
 
-	desc := fmt.Sprintf("%v:(%v)%v", t.env, ip, remark)
-	node, err := t.jenkins.CreateNode(ctx, ip, cdNodeInfo.numExecutors, desc, cdNodeInfo.remoteFs, ip,
+	meta := &CdNodeMeta{Env: t.env, Ip: ip, Remark: remark, CreatedAt: time.Now()}
+	desc := meta.Encode()
+	label := formatNodeLabelString(ip, cdNodeInfo.labels)
+	node, err := t.jenkins.CreateNode(ctx, ip, cdNodeInfo.numExecutors, desc, cdNodeInfo.remoteFs, label,
 		map[string]string{
 			"method":        "SSHLauncher",
 			"host":          ip,
@@ -70,6 +78,90 @@ func (t *CdNodeBroker) CreateNode(ctx context.Context, ip, remark string, option
 	return nil
 }
 
+//在原节点上修改配置，保留节点历史，未传入的参数保持不变
+func (t *CdNodeBroker) UpdateNode(ctx context.Context, ip string, options ...CdNodeOption) error {
+	node := t.GetNodeByName(ip)
+	if node == nil {
+		return fmt.Errorf("%w: %v", ErrNodeNotFound, ip)
+	}
+
+	nodeParam, config, err := t.getNodeParam(ctx, node)
+	if err != nil {
+		log.Error(ctx, "UpdateNode get config failed: %v, err: %v", ip, err)
+		return err
+	}
+
+	for _, option := range options {
+		option(nodeParam)
+	}
+
+	for key, value := range nodeParam.labels {
+		if !isValidLabelToken(key) || !isValidLabelToken(value) {
+			return fmt.Errorf("invalid node label: %v=%v", key, value)
+		}
+	}
+
+	if err = t.applyNodeParam(ctx, node, config, nodeParam, node.Remark()); err != nil {
+		return err
+	}
+
+	t.UpdateNodeCache(ctx)
+	log.Info(ctx, "UpdateNode: %v", ip)
+	return nil
+}
+
+//临时下线节点(维护窗口)，下线期间拒绝部署
+func (t *CdNodeBroker) DisableNode(ctx context.Context, ip, reason string) error {
+	node, err := t.jenkins.GetNode(ctx, ip)
+	if err != nil {
+		return err
+	}
+
+	if !node.Raw.TemporarilyOffline {
+		if _, err = node.ToggleTemporarilyOffline(ctx, reason); err != nil {
+			log.Error(ctx, "DisableNode failed: %v, err: %v", ip, err)
+			return err
+		}
+	}
+
+	t.UpdateNodeCache(ctx)
+	log.Info(ctx, "DisableNode: %v, reason: %v", ip, reason)
+	return nil
+}
+
+func (t *CdNodeBroker) EnableNode(ctx context.Context, ip string) error {
+	node, err := t.jenkins.GetNode(ctx, ip)
+	if err != nil {
+		return err
+	}
+
+	if node.Raw.TemporarilyOffline {
+		if _, err = node.ToggleTemporarilyOffline(ctx); err != nil {
+			log.Error(ctx, "EnableNode failed: %v, err: %v", ip, err)
+			return err
+		}
+	}
+
+	t.UpdateNodeCache(ctx)
+	log.Info(ctx, "EnableNode: %v", ip)
+	return nil
+}
+
+//检查节点当前是否被临时下线或未连接，job分配到不可用节点会一直排队
+func (t *CdNodeBroker) checkNodeEnabled(ctx context.Context, node *CdNode) error {
+	disabled, err := node.IsTemporarilyOffline(ctx)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		return fmt.Errorf("%w: %v %v", ErrNodeDisabled, node.GetName(), node.Raw.OfflineCauseReason)
+	}
+	if node.Raw.Offline {
+		return fmt.Errorf("%w: %v", ErrNodeOffline, node.GetName())
+	}
+	return nil
+}
+
 func (t *CdNodeBroker) DeleteNode(ctx context.Context, ip string) (bool, error) {
 	node, err := t.jenkins.GetNode(ctx, ip)
 	if err != nil {
@@ -97,7 +189,7 @@ func (t *CdNodeBroker) UpdateNodeCache(ctx context.Context) error {
 	return nil
 }
 
-func (t *CdNodeBroker) GetNodeByName(name string) *gojenkins.Node {
+func (t *CdNodeBroker) GetNodeByName(name string) *CdNode {
 	node, ok := t.nodesCache[name]
 	if ok {
 		return node
@@ -105,31 +197,133 @@ func (t *CdNodeBroker) GetNodeByName(name string) *gojenkins.Node {
 	return nil
 }
 
-func (t *CdNodeBroker) getAllNodes(ctx context.Context) ([]*gojenkins.Node, error) {
+func (t *CdNodeBroker) getNodeNames() []string {
+	names := make([]string, 0, len(t.nodesCache))
+	for name := range t.nodesCache {
+		names = append(names, name)
+	}
+	return names
+}
+
+//按标签选择节点 selector: "role=api,zone in (a,b),!canary"，不包含jenkins master
+func (t *CdNodeBroker) SelectNodes(selector string) ([]*CdNode, error) {
+	nodeSelector, err := ParseCdNodeSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*CdNode, 0)
+	for _, node := range t.nodesCache {
+		if !node.isMaster() && nodeSelector.Matches(node.Labels()) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].GetName() < nodes[j].GetName()
+	})
+	return nodes, nil
+}
+
+//按标签值分组 eg: GroupNodes("zone") => {"a": [...], "b": [...]}，不包含jenkins master
+func (t *CdNodeBroker) GroupNodes(labelKey string) map[string][]*CdNode {
+	groups := make(map[string][]*CdNode)
+	for _, node := range t.nodesCache {
+		value, ok := node.Labels()[labelKey]
+		if !ok || node.isMaster() {
+			continue
+		}
+		groups[value] = append(groups[value], node)
+	}
+
+	for _, nodes := range groups {
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].GetName() < nodes[j].GetName()
+		})
+	}
+	return groups
+}
+
+//将旧版本描述格式(env:(ip)remark)的本环境节点迁移为结构化元数据，返回迁移的节点名
+func (t *CdNodeBroker) MigrateNodes(ctx context.Context) ([]string, error) {
 	nodes, err := t.jenkins.GetAllNodes(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	envNodes := make([]*gojenkins.Node, 0, len(nodes))
+	migrated := make([]string, 0)
 	for _, node := range nodes {
-		if !strings.HasPrefix(node.Raw.Description, t.env) && node.Raw.DisplayName != "master" {
+		cdNode := NewCdNode(node)
+		if !cdNode.IsLegacy() || cdNode.Env() != t.env {
 			continue
 		}
 
-		envNodes = append(envNodes, node)
+		config, err := getNodeConfig(ctx, node)
+		if err != nil {
+			log.Error(ctx, "MigrateNodes get config failed: %v, err: %v", node.GetName(), err)
+			return migrated, err
+		}
+
+		config, err = setXmlElement(config, "description", cdNode.Meta().Encode())
+		if err != nil {
+			return migrated, err
+		}
+
+		if err = updateNodeConfig(ctx, node, config); err != nil {
+			log.Error(ctx, "MigrateNodes update config failed: %v, err: %v", node.GetName(), err)
+			return migrated, err
+		}
+
+		log.Info(ctx, "MigrateNodes: %v", node.GetName())
+		migrated = append(migrated, node.GetName())
+	}
+
+	if len(migrated) > 0 {
+		t.UpdateNodeCache(ctx)
+	}
+	return migrated, nil
+}
+
+//按元数据env精确匹配，master节点始终可用
+func (t *CdNodeBroker) getAllNodes(ctx context.Context) ([]*CdNode, error) {
+	nodes, err := t.jenkins.GetAllNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	envNodes := make([]*CdNode, 0, len(nodes))
+	for _, node := range nodes {
+		cdNode := NewCdNode(node)
+		if cdNode.Env() != t.env && !cdNode.isMaster() {
+			continue
+		}
+
+		envNodes = append(envNodes, cdNode)
 	}
 
 	return envNodes, nil
 }
 
-func (t *CdNodeBroker) getAllNodesMap(ctx context.Context) (map[string]*gojenkins.Node, error) {
+func (t *CdNodeBroker) mergeNodeParam(options ...CdNodeOption) *CdNodeParam {
+	cdNodeInfo := t.defCdNodeParam
+	if len(options) > 0 {
+		cdNodeInfo = &CdNodeParam{}
+		*cdNodeInfo = *t.defCdNodeParam
+
+		for _, option := range options {
+			option(cdNodeInfo)
+		}
+	}
+	return cdNodeInfo
+}
+
+func (t *CdNodeBroker) getAllNodesMap(ctx context.Context) (map[string]*CdNode, error) {
 	nodes, err := t.getAllNodes(ctx)
 	if err != nil {
-		return make(map[string]*gojenkins.Node), err
+		return make(map[string]*CdNode), err
 	}
 
-	nodesMap := make(map[string]*gojenkins.Node)
+	nodesMap := make(map[string]*CdNode)
 	for _, node := range nodes {
 		nodesMap[node.GetName()] = node
 	}
@@ -143,6 +337,12 @@ type CdNodeParam struct {
 	numExecutors  int
 	remoteFs      string
 	sshPort       string
+	labels        map[string]string
+
+	//节点初始化(BootstrapNode)使用
+	sshUser    string
+	sshKeyFile string
+	deployUser string
 }
 
 func NewCdNodeParam(options ...CdNodeOption) *CdNodeParam {
@@ -191,3 +391,64 @@ func CdNodeSshPortOption(sshPort string) CdNodeOption {
 		nodeInfo.sshPort = sshPort
 	}
 }
+
+func CdNodeSshUserOption(sshUser string) CdNodeOption {
+	return func(nodeInfo *CdNodeParam) {
+		nodeInfo.sshUser = sshUser
+	}
+}
+
+func CdNodeSshKeyFileOption(keyFile string) CdNodeOption {
+	return func(nodeInfo *CdNodeParam) {
+		nodeInfo.sshKeyFile = keyFile
+	}
+}
+
+//部署专用用户，初始化时创建并作为remoteFs目录属主
+func CdNodeDeployUserOption(deployUser string) CdNodeOption {
+	return func(nodeInfo *CdNodeParam) {
+		nodeInfo.deployUser = deployUser
+	}
+}
+
+//节点标签 key=value 形式存储为jenkins节点label, eg: role=api zone=a tier=canary
+func CdNodeLabelsOption(labels map[string]string) CdNodeOption {
+	return func(nodeInfo *CdNodeParam) {
+		nodeInfo.labels = make(map[string]string, len(labels))
+		for key, value := range labels {
+			nodeInfo.labels[key] = value
+		}
+	}
+}
+
+//读取节点上的 key=value 标签
+func GetNodeLabels(node *gojenkins.Node) map[string]string {
+	labels := make(map[string]string)
+	if node == nil || node.Raw == nil {
+		return labels
+	}
+
+	for _, label := range node.Raw.AssignedLabels {
+		kv := strings.SplitN(label.Name, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels
+}
+
+//jenkins label以空格分隔, 第一个固定为节点名(ip), job通过ip绑定节点
+func formatNodeLabelString(ip string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	atoms := []string{ip}
+	for _, key := range keys {
+		atoms = append(atoms, fmt.Sprintf("%v=%v", key, labels[key]))
+	}
+	return strings.Join(atoms, " ")
+}
@@ -0,0 +1,299 @@
+package gocd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/liumingmin/goutils/log"
+)
+
+//节点初始化前检查项输出格式 gocd:preflight:<name>:<ok|fail>:<detail>
+const preflightLinePrefix = "gocd:preflight:"
+
+type CdSshExecutor interface {
+	Run(ctx context.Context, host, port, script string) (string, error) // 通过ssh在远端执行bash脚本，返回输出
+}
+
+type sshCmdExecutor struct {
+	user    string
+	keyFile string
+}
+
+//使用本机ssh命令执行，要求gocd所在机器能免密登录目标节点
+func NewSshCmdExecutor(user, keyFile string) CdSshExecutor {
+	return &sshCmdExecutor{user: user, keyFile: keyFile}
+}
+
+func (e *sshCmdExecutor) Run(ctx context.Context, host, port, script string) (string, error) {
+	args := []string{"-p", port, "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new"}
+	if e.keyFile != "" {
+		args = append(args, "-i", e.keyFile)
+	}
+
+	target := host
+	if e.user != "" {
+		target = e.user + "@" + host
+	}
+	args = append(args, target, "bash -s")
+
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+type CdPreflightItem struct {
+	Name      string
+	Pass      bool
+	Detail    string
+	Installed bool // 本次初始化过程中安装或创建
+}
+
+type CdPreflightReport struct {
+	Host  string
+	Items []*CdPreflightItem
+}
+
+func (r *CdPreflightReport) Passed() bool {
+	if len(r.Items) == 0 {
+		return false
+	}
+	for _, item := range r.Items {
+		if !item.Pass {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CdPreflightReport) FailedItems() []*CdPreflightItem {
+	items := make([]*CdPreflightItem, 0)
+	for _, item := range r.Items {
+		if !item.Pass {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (r *CdPreflightReport) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("preflight %v:\n", r.Host))
+	for _, item := range r.Items {
+		status := "PASS"
+		if !item.Pass {
+			status = "FAIL"
+		}
+		installed := ""
+		if item.Installed {
+			installed = " (installed)"
+		}
+		sb.WriteString(fmt.Sprintf("[%v] %v%v %v\n", status, item.Name, installed, item.Detail))
+	}
+	return sb.String()
+}
+
+//只检查不安装
+func (t *CdNodeBroker) PreflightNode(ctx context.Context, ip string, options ...CdNodeOption) (*CdPreflightReport, error) {
+	cdNodeInfo := t.mergeNodeParam(options...)
+	return t.runPreflight(ctx, ip, cdNodeInfo)
+}
+
+//检查并安装节点依赖(java curl rsync flock tar)，创建部署用户和remoteFs目录，全部通过后注册jenkins节点
+func (t *CdNodeBroker) BootstrapNode(ctx context.Context, ip, remark string, options ...CdNodeOption) (*CdPreflightReport, error) {
+	cdNodeInfo := t.mergeNodeParam(options...)
+
+	report, err := t.runPreflight(ctx, ip, cdNodeInfo)
+	if err != nil {
+		return report, err
+	}
+
+	failedItems := report.FailedItems()
+	if len(failedItems) > 0 {
+		output, installErr := t.getSshExecutor(cdNodeInfo).Run(ctx, ip, cdNodeInfo.sshPort, buildInstallScript(cdNodeInfo, failedItems))
+		log.Info(ctx, "BootstrapNode install %v output: %v", ip, output)
+		if installErr != nil {
+			log.Error(ctx, "BootstrapNode install failed: %v, err: %v", ip, installErr)
+		}
+
+		report, err = t.runPreflight(ctx, ip, cdNodeInfo)
+		if installErr != nil {
+			report.Items = append(report.Items, &CdPreflightItem{Name: "install", Detail: strings.TrimSpace(lastLine(output) + " " + installErr.Error())})
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, item := range report.Items {
+			for _, failedItem := range failedItems {
+				if item.Name == failedItem.Name && item.Pass {
+					item.Installed = true
+				}
+			}
+		}
+	}
+
+	if !report.Passed() {
+		log.Error(ctx, "BootstrapNode preflight failed: %v", report)
+		return report, errors.New("node preflight failed")
+	}
+
+	return report, t.CreateNode(ctx, ip, remark, options...)
+}
+
+func (t *CdNodeBroker) runPreflight(ctx context.Context, ip string, cdNodeInfo *CdNodeParam) (*CdPreflightReport, error) {
+	report := &CdPreflightReport{Host: ip}
+
+	output, err := t.getSshExecutor(cdNodeInfo).Run(ctx, ip, cdNodeInfo.sshPort, buildPreflightScript(cdNodeInfo))
+	if err != nil && !strings.Contains(output, preflightLinePrefix) {
+		report.Items = append(report.Items, &CdPreflightItem{Name: "ssh", Detail: strings.TrimSpace(output + " " + err.Error())})
+		log.Error(ctx, "runPreflight ssh failed: %v, err: %v", ip, err)
+		return report, err
+	}
+
+	report.Items = append(report.Items, &CdPreflightItem{Name: "ssh", Pass: true})
+	report.Items = append(report.Items, parsePreflightOutput(output, getPreflightChecks(cdNodeInfo))...)
+	return report, nil
+}
+
+func (t *CdNodeBroker) getSshExecutor(cdNodeInfo *CdNodeParam) CdSshExecutor {
+	if t.sshExecutor != nil {
+		return t.sshExecutor
+	}
+	return NewSshCmdExecutor(cdNodeInfo.sshUser, cdNodeInfo.sshKeyFile)
+}
+
+//没有输出结果的检查项(脚本中途退出、sudo等待输入、输出被截断)视为失败
+func parsePreflightOutput(output string, checks []*cdPreflightCheck) []*CdPreflightItem {
+	items := make([]*CdPreflightItem, 0)
+	outputItems := make(map[string]*CdPreflightItem)
+	scanner := bufio.NewScanner(bytes.NewBufferString(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, preflightLinePrefix) {
+			continue
+		}
+
+		fields := strings.SplitN(line[len(preflightLinePrefix):], ":", 3)
+		if len(fields) < 2 {
+			continue
+		}
+
+		item := &CdPreflightItem{Name: fields[0], Pass: fields[1] == "ok"}
+		if len(fields) == 3 {
+			item.Detail = fields[2]
+		}
+		outputItems[item.Name] = item
+	}
+
+	for _, check := range checks {
+		item, ok := outputItems[check.name]
+		if !ok {
+			item = &CdPreflightItem{Name: check.name, Detail: "no preflight output"}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
+
+//单引号转义，用于拼接到远端脚本中的参数
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+type cdPreflightCheck struct {
+	name    string
+	check   string // 成功时输出详情，失败时返回非0
+	install string
+}
+
+func getPreflightChecks(cdNodeInfo *CdNodeParam) []*cdPreflightCheck {
+	checks := []*cdPreflightCheck{
+		{name: "java", check: `command -v java >/dev/null && java -version 2>&1 | head -n 1`, install: `gocd_install java`},
+		{name: "curl", check: `command -v curl`, install: `gocd_install curl`},
+		{name: "rsync", check: `command -v rsync`, install: `gocd_install rsync`},
+		{name: "flock", check: `command -v flock`, install: `gocd_install flock`},
+		{name: "tar", check: `command -v tar`, install: `gocd_install tar`},
+	}
+
+	owner := `"$(id -un)"`
+	if cdNodeInfo.deployUser != "" {
+		owner = shellQuote(cdNodeInfo.deployUser)
+		checks = append(checks, &cdPreflightCheck{
+			name:    "deploy_user",
+			check:   fmt.Sprintf(`id %v`, owner),
+			install: fmt.Sprintf(`${SUDO} useradd -m -s /bin/bash %v`, owner),
+		})
+	}
+
+	remoteFs := shellQuote(cdNodeInfo.remoteFs)
+	checks = append(checks, &cdPreflightCheck{
+		name:    "remote_fs",
+		check:   fmt.Sprintf(`test -d %v && test "$(stat -c %%U %v)" = %v && echo %v`, remoteFs, remoteFs, owner, remoteFs),
+		install: fmt.Sprintf(`${SUDO} mkdir -p %v && ${SUDO} chown -R %v %v`, remoteFs, owner, remoteFs),
+	})
+	return checks
+}
+
+func buildPreflightScript(cdNodeInfo *CdNodeParam) string {
+	var sb strings.Builder
+	for _, check := range getPreflightChecks(cdNodeInfo) {
+		sb.WriteString(fmt.Sprintf(`DETAIL=$( %v 2>&1 )
+if [[ $? -eq 0 ]]; then
+    echo "%v%v:ok:$(echo ${DETAIL} | tr '\n' ' ')"
+else
+    echo "%v%v:fail:$(echo ${DETAIL} | tr '\n' ' ')"
+fi
+`, check.check, preflightLinePrefix, check.name, preflightLinePrefix, check.name))
+	}
+	return sb.String()
+}
+
+func buildInstallScript(cdNodeInfo *CdNodeParam, failedItems []*CdPreflightItem) string {
+	var sb strings.Builder
+	sb.WriteString(installScriptHeader)
+	for _, check := range getPreflightChecks(cdNodeInfo) {
+		for _, item := range failedItems {
+			if item.Name == check.name {
+				sb.WriteString(check.install + "\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+const installScriptHeader = `SUDO=""
+if [[ $(id -u) -ne 0 ]]; then
+    SUDO="sudo -n"
+fi
+
+gocd_install() {
+    if command -v apt-get >/dev/null 2>&1; then
+        case $1 in
+            java) PKG=openjdk-11-jre-headless ;;
+            flock) PKG=util-linux ;;
+            *) PKG=$1 ;;
+        esac
+        ${SUDO} apt-get install -y ${PKG} || (${SUDO} apt-get update && ${SUDO} apt-get install -y ${PKG})
+    elif command -v yum >/dev/null 2>&1; then
+        case $1 in
+            java) PKG=java-11-openjdk-headless ;;
+            flock) PKG=util-linux ;;
+            *) PKG=$1 ;;
+        esac
+        ${SUDO} yum install -y ${PKG}
+    else
+        echo "gocd: no supported package manager for $1"
+        return 1
+    fi
+}
+`
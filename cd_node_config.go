@@ -0,0 +1,230 @@
+package gocd
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/liumingmin/gojenkins"
+	"github.com/liumingmin/goutils/log"
+)
+
+type cdNodeConfigXml struct {
+	Name         string `xml:"name"`
+	Description  string `xml:"description"`
+	RemoteFS     string `xml:"remoteFS"`
+	NumExecutors int    `xml:"numExecutors"`
+	Label        string `xml:"label"`
+	Launcher     struct {
+		Host          string `xml:"host"`
+		Port          string `xml:"port"`
+		CredentialsId string `xml:"credentialsId"`
+		JvmOptions    string `xml:"jvmOptions"`
+	} `xml:"launcher"`
+}
+
+//从节点config.xml读取当前节点参数
+func (t *CdNodeBroker) getNodeParam(ctx context.Context, node *CdNode) (*CdNodeParam, string, error) {
+	config, err := getNodeConfig(ctx, node.Node)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nodeConfig := &cdNodeConfigXml{}
+	if err = unmarshalJenkinsXml(config, nodeConfig); err != nil {
+		return nil, config, err
+	}
+
+	labels := make(map[string]string)
+	for _, atom := range strings.Fields(nodeConfig.Label) {
+		kv := strings.SplitN(atom, "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			labels[kv[0]] = kv[1]
+		}
+	}
+
+	nodeParam := &CdNodeParam{}
+	*nodeParam = *t.defCdNodeParam
+	nodeParam.numExecutors = nodeConfig.NumExecutors
+	nodeParam.remoteFs = nodeConfig.RemoteFS
+	nodeParam.sshPort = nodeConfig.Launcher.Port
+	nodeParam.credentialsId = nodeConfig.Launcher.CredentialsId
+	nodeParam.jvmOptions = nodeConfig.Launcher.JvmOptions
+	nodeParam.labels = labels
+	return nodeParam, config, nil
+}
+
+//将节点参数写回config.xml，保留jenkins其他配置和节点历史
+func (t *CdNodeBroker) applyNodeParam(ctx context.Context, node *CdNode, config string, nodeParam *CdNodeParam, remark string) error {
+	meta := &CdNodeMeta{Env: t.env, Ip: node.GetName()}
+	if node.Meta() != nil {
+		*meta = *node.Meta()
+	}
+	meta.Remark = remark
+
+	var err error
+	elements := []struct {
+		parent string
+		tag    string
+		value  string
+	}{
+		{"", "description", meta.Encode()},
+		{"", "numExecutors", strconv.Itoa(nodeParam.numExecutors)},
+		{"", "remoteFS", nodeParam.remoteFs},
+		{"", "label", formatNodeLabelString(node.GetName(), nodeParam.labels)},
+		{"launcher", "port", nodeParam.sshPort},
+		{"launcher", "credentialsId", nodeParam.credentialsId},
+		{"launcher", "jvmOptions", nodeParam.jvmOptions},
+	}
+	for _, element := range elements {
+		config, err = upsertXmlElement(config, element.parent, element.tag, element.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = updateNodeConfig(ctx, node.Node, config); err != nil {
+		log.Error(ctx, "update node config failed: %v, err: %v", node.GetName(), err)
+		return err
+	}
+	return nil
+}
+
+func getNodeConfig(ctx context.Context, node *gojenkins.Node) (string, error) {
+	var config string
+	_, err := node.Jenkins.Requester.GetXML(ctx, node.Base+"/config.xml", &config, nil)
+	if err != nil {
+		return "", err
+	}
+	return config, nil
+}
+
+func updateNodeConfig(ctx context.Context, node *gojenkins.Node, config string) error {
+	resp, err := node.Jenkins.Requester.PostXML(ctx, node.Base+"/config.xml", config, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return errors.New(strconv.Itoa(resp.StatusCode))
+	}
+
+	_, err = node.Poll(ctx)
+	return err
+}
+
+//元素在config中的位置
+type xmlElementRange struct {
+	start      int
+	end        int
+	closeStart int // 结束标签起始位置，自闭合元素时等于start
+}
+
+//按路径查找元素，路径相对根元素，如launcher/port，为空时为根元素，只匹配该路径下的元素
+func findXmlElement(config, path string) (*xmlElementRange, error) {
+	names := make([]string, 0)
+	if path != "" {
+		names = strings.Split(path, "/")
+	}
+
+	//替换版本号不改变长度，保证偏移量和原config一致
+	decoder := xml.NewDecoder(strings.NewReader(xmlVersion11Regexp.ReplaceAllStringFunc(config, func(decl string) string {
+		return strings.Replace(decl, "1.1", "1.0", 1)
+	})))
+
+	stack := make([]string, 0)
+	var found *xmlElementRange
+	for {
+		offset := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("not found element: %v, err: %v", path, err)
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, token.Name.Local)
+			if found == nil && isXmlPath(stack[1:], names) {
+				found = &xmlElementRange{start: offset}
+			}
+		case xml.EndElement:
+			if found != nil && len(stack) == len(names)+1 {
+				found.end = int(decoder.InputOffset())
+				found.closeStart = offset
+				if offset == found.end {
+					found.closeStart = found.start
+				}
+				return found, nil
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+func isXmlPath(stack, names []string) bool {
+	if len(stack) != len(names) {
+		return false
+	}
+	for idx := range names {
+		if stack[idx] != names[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatXmlElement(tag, value string) (string, error) {
+	var escaped bytes.Buffer
+	if err := xml.EscapeText(&escaped, []byte(value)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%v>%v</%v>", tag, escaped.String(), tag), nil
+}
+
+//替换config.xml中path指定元素的文本值，保留其他未知配置
+func setXmlElement(config, path, value string) (string, error) {
+	loc, err := findXmlElement(config, path)
+	if err != nil {
+		return config, err
+	}
+
+	element, err := formatXmlElement(path[strings.LastIndex(path, "/")+1:], value)
+	if err != nil {
+		return config, err
+	}
+	return config[:loc.start] + element + config[loc.end:], nil
+}
+
+//元素不存在时插入到parent元素末尾，parent为空时为根元素
+func upsertXmlElement(config, parent, tag, value string) (string, error) {
+	path := strings.TrimPrefix(parent+"/"+tag, "/")
+	if newConfig, err := setXmlElement(config, path, value); err == nil {
+		return newConfig, nil
+	}
+
+	loc, err := findXmlElement(config, parent)
+	if err != nil {
+		return config, err
+	}
+	if loc.closeStart == loc.start {
+		return config, fmt.Errorf("element is self-closing: %v", parent)
+	}
+
+	element, err := formatXmlElement(tag, value)
+	if err != nil {
+		return config, err
+	}
+	return config[:loc.closeStart] + element + config[loc.closeStart:], nil
+}
+
+var xmlVersion11Regexp = regexp.MustCompile(`^\s*<\?xml\s+version=['"]1\.1['"]`)
+
+//jenkins配置使用xml 1.1声明，encoding/xml只支持1.0
+func unmarshalJenkinsXml(config string, v interface{}) error {
+	config = xmlVersion11Regexp.ReplaceAllString(config, "<?xml version='1.0'")
+	return xml.Unmarshal([]byte(config), v)
+}
@@ -0,0 +1,694 @@
+package gocd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/liumingmin/goutils/log"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	INVENTORY_FORMAT_YAML = "yaml"
+	INVENTORY_FORMAT_CSV  = "csv"
+	INVENTORY_FORMAT_INI  = "ini" // ansible inventory
+)
+
+const (
+	RECONCILE_ACTION_CREATE = "create"
+	RECONCILE_ACTION_UPDATE = "update"
+	RECONCILE_ACTION_DELETE = "delete"
+)
+
+var inventoryCsvHeader = []string{"ip", "remark", "labels", "credentialsId", "sshPort", "numExecutors", "jvmOptions", "remoteFs"}
+
+//节点清单，创建节点时未设置的字段使用CdNodeBroker默认节点参数，更新节点时未设置的字段保留当前值
+type CdInventoryNode struct {
+	Ip            string            `yaml:"ip"`
+	Remark        string            `yaml:"remark,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty"` // 为nil时不修改标签
+	CredentialsId string            `yaml:"credentialsId,omitempty"`
+	SshPort       string            `yaml:"sshPort,omitempty"`
+	NumExecutors  int               `yaml:"numExecutors,omitempty"`
+	JvmOptions    string            `yaml:"jvmOptions,omitempty"`
+	RemoteFs      string            `yaml:"remoteFs,omitempty"`
+}
+
+func (n *CdInventoryNode) Options() []CdNodeOption {
+	options := make([]CdNodeOption, 0)
+	if n.CredentialsId != "" {
+		options = append(options, CdNodeCredIdOption(n.CredentialsId))
+	}
+	if n.SshPort != "" {
+		options = append(options, CdNodeSshPortOption(n.SshPort))
+	}
+	if n.NumExecutors > 0 {
+		options = append(options, CdNodeNumExecutorsOption(n.NumExecutors))
+	}
+	if n.JvmOptions != "" {
+		options = append(options, CdNodeJvmOption(n.JvmOptions))
+	}
+	if n.RemoteFs != "" {
+		options = append(options, CdNodeRemoteFsOption(n.RemoteFs))
+	}
+	//清单中的标签为全量标签
+	if n.Labels != nil {
+		options = append(options, CdNodeLabelsOption(n.Labels))
+	}
+	return options
+}
+
+type CdInventory struct {
+	Nodes []*CdInventoryNode `yaml:"nodes"`
+}
+
+//按扩展名识别格式: .yml/.yaml .csv 其他按ansible ini处理
+func LoadCdInventory(path string) (*CdInventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := INVENTORY_FORMAT_INI
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		format = INVENTORY_FORMAT_YAML
+	case ".csv":
+		format = INVENTORY_FORMAT_CSV
+	}
+	return ParseCdInventory(data, format)
+}
+
+func ParseCdInventory(data []byte, format string) (*CdInventory, error) {
+	var inventory *CdInventory
+	var err error
+	switch format {
+	case INVENTORY_FORMAT_YAML:
+		inventory = &CdInventory{}
+		err = yaml.Unmarshal(data, inventory)
+	case INVENTORY_FORMAT_CSV:
+		inventory, err = parseInventoryCsv(data)
+	case INVENTORY_FORMAT_INI:
+		inventory, err = parseInventoryIni(data)
+	default:
+		err = fmt.Errorf("unsupported inventory format: %v", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make(map[string]bool)
+	for _, node := range inventory.Nodes {
+		if node.Ip == "" {
+			return nil, fmt.Errorf("inventory node ip is empty")
+		}
+		if ips[node.Ip] {
+			return nil, fmt.Errorf("duplicate inventory node: %v", node.Ip)
+		}
+		ips[node.Ip] = true
+
+		for key, value := range node.Labels {
+			if !isValidLabelToken(key) || !isValidLabelToken(value) {
+				return nil, fmt.Errorf("invalid node label: %v=%v", key, value)
+			}
+		}
+	}
+	return inventory, nil
+}
+
+func (i *CdInventory) Marshal(format string) ([]byte, error) {
+	switch format {
+	case INVENTORY_FORMAT_YAML:
+		return yaml.Marshal(i)
+	case INVENTORY_FORMAT_CSV:
+		return marshalInventoryCsv(i)
+	case INVENTORY_FORMAT_INI:
+		return marshalInventoryIni(i), nil
+	}
+	return nil, fmt.Errorf("unsupported inventory format: %v", format)
+}
+
+//导出本环境节点清单
+func (t *CdNodeBroker) ExportInventory(ctx context.Context, format string) ([]byte, error) {
+	nodes, err := t.getAllNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := &CdInventory{Nodes: make([]*CdInventoryNode, 0, len(nodes))}
+	for _, node := range nodes {
+		if node.isMaster() {
+			continue
+		}
+
+		nodeParam, _, err := t.getNodeParam(ctx, node)
+		if err != nil {
+			log.Error(ctx, "ExportInventory get node config failed: %v, err: %v", node.GetName(), err)
+			return nil, err
+		}
+
+		inventory.Nodes = append(inventory.Nodes, &CdInventoryNode{
+			Ip:            node.GetName(),
+			Remark:        node.Remark(),
+			Labels:        nodeParam.labels,
+			CredentialsId: nodeParam.credentialsId,
+			SshPort:       nodeParam.sshPort,
+			NumExecutors:  nodeParam.numExecutors,
+			JvmOptions:    nodeParam.jvmOptions,
+			RemoteFs:      nodeParam.remoteFs,
+		})
+	}
+	return inventory.Marshal(format)
+}
+
+type CdReconcileAction struct {
+	Action  string
+	Ip      string
+	Changes []string
+	Err     error
+}
+
+type CdReconcilePlan struct {
+	DryRun  bool
+	Actions []*CdReconcileAction
+}
+
+func (p *CdReconcilePlan) String() string {
+	symbols := map[string]string{
+		RECONCILE_ACTION_CREATE: "+",
+		RECONCILE_ACTION_UPDATE: "~",
+		RECONCILE_ACTION_DELETE: "-",
+	}
+
+	var sb strings.Builder
+	for _, action := range p.Actions {
+		sb.WriteString(fmt.Sprintf("%v %v\n", symbols[action.Action], action.Ip))
+		for _, change := range action.Changes {
+			sb.WriteString(fmt.Sprintf("    %v\n", change))
+		}
+		if action.Err != nil {
+			sb.WriteString(fmt.Sprintf("    error: %v\n", action.Err))
+		}
+	}
+	return sb.String()
+}
+
+type cdReconcileParam struct {
+	dryRun bool
+	prune  bool
+}
+
+type CdReconcileOption func(*cdReconcileParam)
+
+//只输出差异，不修改jenkins
+func CdReconcileDryRunOption() CdReconcileOption {
+	return func(param *cdReconcileParam) {
+		param.dryRun = true
+	}
+}
+
+//删除清单中不存在的本环境节点
+func CdReconcilePruneOption() CdReconcileOption {
+	return func(param *cdReconcileParam) {
+		param.prune = true
+	}
+}
+
+//按节点清单同步: 创建缺少的节点，更新配置变化的节点，可选删除多余节点
+func (t *CdNodeBroker) Reconcile(ctx context.Context, inventory *CdInventory, options ...CdReconcileOption) (*CdReconcilePlan, error) {
+	reconcileParam := &cdReconcileParam{}
+	for _, option := range options {
+		option(reconcileParam)
+	}
+
+	if err := t.UpdateNodeCache(ctx); err != nil {
+		return nil, err
+	}
+
+	plan := &CdReconcilePlan{DryRun: reconcileParam.dryRun}
+	desiredIps := make(map[string]bool)
+	for _, invNode := range inventory.Nodes {
+		desiredIps[invNode.Ip] = true
+
+		node := t.GetNodeByName(invNode.Ip)
+		if node == nil {
+			desired := t.mergeNodeParam(invNode.Options()...)
+			action := &CdReconcileAction{Action: RECONCILE_ACTION_CREATE, Ip: invNode.Ip, Changes: describeNodeParam(desired)}
+			if !reconcileParam.dryRun {
+				action.Err = t.CreateNode(ctx, invNode.Ip, invNode.Remark, invNode.Options()...)
+			}
+			plan.Actions = append(plan.Actions, action)
+			continue
+		}
+
+		current, config, err := t.getNodeParam(ctx, node)
+		if err != nil {
+			log.Error(ctx, "Reconcile get node config failed: %v, err: %v", node.GetName(), err)
+			plan.Actions = append(plan.Actions, &CdReconcileAction{Action: RECONCILE_ACTION_UPDATE, Ip: invNode.Ip, Err: err})
+			continue
+		}
+
+		desired := mergeInventoryNodeParam(current, invNode)
+		remark := invNode.Remark
+		if remark == "" {
+			remark = node.Remark()
+		}
+
+		changes := diffNodeParam(current, desired)
+		if node.Remark() != remark {
+			changes = append(changes, fmt.Sprintf("remark: %q -> %q", node.Remark(), remark))
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		action := &CdReconcileAction{Action: RECONCILE_ACTION_UPDATE, Ip: invNode.Ip, Changes: changes}
+		if !reconcileParam.dryRun {
+			action.Err = t.applyNodeParam(ctx, node, config, desired, remark)
+		}
+		plan.Actions = append(plan.Actions, action)
+	}
+
+	if reconcileParam.prune {
+		names := make([]string, 0)
+		for name, node := range t.nodesCache {
+			if !desiredIps[name] && !node.isMaster() {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			action := &CdReconcileAction{Action: RECONCILE_ACTION_DELETE, Ip: name}
+			if !reconcileParam.dryRun {
+				_, action.Err = t.DeleteNode(ctx, name)
+			}
+			plan.Actions = append(plan.Actions, action)
+		}
+	}
+
+	if !reconcileParam.dryRun {
+		t.UpdateNodeCache(ctx)
+	}
+
+	log.Info(ctx, "Reconcile plan: %v", plan)
+	return plan, nil
+}
+
+//清单中设置的字段覆盖节点当前参数
+func mergeInventoryNodeParam(current *CdNodeParam, invNode *CdInventoryNode) *CdNodeParam {
+	desired := &CdNodeParam{}
+	*desired = *current
+	for _, option := range invNode.Options() {
+		option(desired)
+	}
+	return desired
+}
+
+func describeNodeParam(param *CdNodeParam) []string {
+	return []string{
+		fmt.Sprintf("numExecutors: %v", param.numExecutors),
+		fmt.Sprintf("sshPort: %v", param.sshPort),
+		fmt.Sprintf("credentialsId: %v", param.credentialsId),
+		fmt.Sprintf("jvmOptions: %v", param.jvmOptions),
+		fmt.Sprintf("remoteFs: %v", param.remoteFs),
+		fmt.Sprintf("labels: %v", formatLabels(param.labels)),
+	}
+}
+
+func diffNodeParam(current, desired *CdNodeParam) []string {
+	changes := make([]string, 0)
+	if current.numExecutors != desired.numExecutors {
+		changes = append(changes, fmt.Sprintf("numExecutors: %v -> %v", current.numExecutors, desired.numExecutors))
+	}
+	if current.sshPort != desired.sshPort {
+		changes = append(changes, fmt.Sprintf("sshPort: %v -> %v", current.sshPort, desired.sshPort))
+	}
+	if current.credentialsId != desired.credentialsId {
+		changes = append(changes, fmt.Sprintf("credentialsId: %v -> %v", current.credentialsId, desired.credentialsId))
+	}
+	if current.jvmOptions != desired.jvmOptions {
+		changes = append(changes, fmt.Sprintf("jvmOptions: %q -> %q", current.jvmOptions, desired.jvmOptions))
+	}
+	if current.remoteFs != desired.remoteFs {
+		changes = append(changes, fmt.Sprintf("remoteFs: %v -> %v", current.remoteFs, desired.remoteFs))
+	}
+	if formatLabels(current.labels) != formatLabels(desired.labels) {
+		changes = append(changes, fmt.Sprintf("labels: %v -> %v", formatLabels(current.labels), formatLabels(desired.labels)))
+	}
+	return changes
+}
+
+//role=api;zone=a
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		kvs = append(kvs, key+"="+labels[key])
+	}
+	return strings.Join(kvs, ";")
+}
+
+func parseLabels(str string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(str, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid label: %v", kv)
+		}
+		labels[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+	return labels, nil
+}
+
+func parseInventoryCsv(data []byte) (*CdInventory, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := &CdInventory{}
+	if len(records) == 0 {
+		return inventory, nil
+	}
+
+	columns := make(map[string]int)
+	for idx, name := range records[0] {
+		columns[strings.TrimSpace(name)] = idx
+	}
+	if _, ok := columns["ip"]; !ok {
+		return nil, fmt.Errorf("csv inventory missing ip column")
+	}
+
+	for _, record := range records[1:] {
+		get := func(name string) string {
+			idx, ok := columns[name]
+			if !ok || idx >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[idx])
+		}
+
+		node := &CdInventoryNode{
+			Ip:            get("ip"),
+			Remark:        get("remark"),
+			CredentialsId: get("credentialsId"),
+			SshPort:       get("sshPort"),
+			JvmOptions:    get("jvmOptions"),
+			RemoteFs:      get("remoteFs"),
+		}
+		if numExecutors := get("numExecutors"); numExecutors != "" {
+			if node.NumExecutors, err = strconv.Atoi(numExecutors); err != nil {
+				return nil, fmt.Errorf("invalid numExecutors: %v", numExecutors)
+			}
+		}
+		if _, ok := columns["labels"]; ok {
+			if node.Labels, err = parseLabels(get("labels")); err != nil {
+				return nil, err
+			}
+		}
+		inventory.Nodes = append(inventory.Nodes, node)
+	}
+	return inventory, nil
+}
+
+func marshalInventoryCsv(inventory *CdInventory) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err := writer.Write(inventoryCsvHeader); err != nil {
+		return nil, err
+	}
+	for _, node := range inventory.Nodes {
+		numExecutors := ""
+		if node.NumExecutors > 0 {
+			numExecutors = strconv.Itoa(node.NumExecutors)
+		}
+		err := writer.Write([]string{node.Ip, node.Remark, formatLabels(node.Labels), node.CredentialsId,
+			node.SshPort, numExecutors, node.JvmOptions, node.RemoteFs})
+		if err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+//ansible inventory中gocd识别的主机变量，其他变量作为节点标签，主机所在组作为group标签
+var inventoryIniVars = map[string]string{
+	"ansible_host":        "ip",
+	"ansible_port":        "sshPort",
+	"ansible_ssh_port":    "sshPort",
+	"gocd_remark":         "remark",
+	"gocd_credentials_id": "credentialsId",
+	"gocd_executors":      "numExecutors",
+	"gocd_jvm_options":    "jvmOptions",
+	"gocd_remote_fs":      "remoteFs",
+}
+
+func parseInventoryIni(data []byte) (*CdInventory, error) {
+	inventory := &CdInventory{}
+	hosts := make(map[string]*CdInventoryNode)
+	hostNames := make([]string, 0)
+	groupHosts := make(map[string][]string)
+	groupVars := make(map[string][]string)
+
+	section, sectionType := "ungrouped", ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, sectionType = line[1:len(line)-1], ""
+			if idx := strings.Index(section, ":"); idx > 0 {
+				section, sectionType = section[:idx], section[idx+1:]
+			}
+			continue
+		}
+
+		fields, err := splitIniFields(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch sectionType {
+		case "vars":
+			groupVars[section] = append(groupVars[section], fields...)
+		case "":
+			host := fields[0]
+			node, ok := hosts[host]
+			if !ok {
+				node = &CdInventoryNode{Ip: host, Labels: make(map[string]string)}
+				hosts[host] = node
+				hostNames = append(hostNames, host)
+				inventory.Nodes = append(inventory.Nodes, node)
+			}
+			if section != "ungrouped" && section != "all" {
+				node.Labels["group"] = section
+			}
+			groupHosts[section] = append(groupHosts[section], host)
+			if err = applyIniVars(node, fields[1:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	//组变量优先级低于主机变量
+	for _, host := range hostNames {
+		node := hosts[host]
+		hostNode := *node
+		hostNode.Labels = make(map[string]string)
+		for key, value := range node.Labels {
+			hostNode.Labels[key] = value
+		}
+
+		if err := applyIniVars(node, groupVars["all"]); err != nil {
+			return nil, err
+		}
+		for group, groupHostNames := range groupHosts {
+			if group != "all" && containsString(groupHostNames, host) {
+				if err := applyIniVars(node, groupVars[group]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		mergeInventoryNode(node, &hostNode)
+	}
+	return inventory, nil
+}
+
+func applyIniVars(node *CdInventoryNode, vars []string) error {
+	for _, kv := range vars {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("invalid inventory var: %v", kv)
+		}
+
+		key, value := pair[0], pair[1]
+		switch inventoryIniVars[key] {
+		case "ip":
+			node.Ip = value
+		case "sshPort":
+			node.SshPort = value
+		case "remark":
+			node.Remark = value
+		case "credentialsId":
+			node.CredentialsId = value
+		case "jvmOptions":
+			node.JvmOptions = value
+		case "remoteFs":
+			node.RemoteFs = value
+		case "numExecutors":
+			numExecutors, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid numExecutors: %v", value)
+			}
+			node.NumExecutors = numExecutors
+		default:
+			if strings.HasPrefix(key, "ansible_") {
+				continue
+			}
+			node.Labels[key] = value
+		}
+	}
+	return nil
+}
+
+func mergeInventoryNode(node, hostNode *CdInventoryNode) {
+	if hostNode.SshPort != "" {
+		node.SshPort = hostNode.SshPort
+	}
+	if hostNode.Remark != "" {
+		node.Remark = hostNode.Remark
+	}
+	if hostNode.CredentialsId != "" {
+		node.CredentialsId = hostNode.CredentialsId
+	}
+	if hostNode.JvmOptions != "" {
+		node.JvmOptions = hostNode.JvmOptions
+	}
+	if hostNode.RemoteFs != "" {
+		node.RemoteFs = hostNode.RemoteFs
+	}
+	if hostNode.NumExecutors > 0 {
+		node.NumExecutors = hostNode.NumExecutors
+	}
+	node.Ip = hostNode.Ip
+	for key, value := range hostNode.Labels {
+		node.Labels[key] = value
+	}
+}
+
+//按空白切分，支持单双引号 eg: gocd_jvm_options="-Xms16m -Xmx64m"
+func splitIniFields(line string) ([]string, error) {
+	fields := make([]string, 0)
+	var field strings.Builder
+	var quote rune
+	for _, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				field.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ' ' || c == '\t':
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteRune(c)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote: %v", line)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func marshalInventoryIni(inventory *CdInventory) []byte {
+	groups := make(map[string][]*CdInventoryNode)
+	for _, node := range inventory.Nodes {
+		group := node.Labels["group"]
+		if group == "" {
+			group = "ungrouped"
+		}
+		groups[group] = append(groups[group], node)
+	}
+
+	groupNames := make([]string, 0, len(groups))
+	for group := range groups {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+
+	var sb strings.Builder
+	for _, group := range groupNames {
+		sb.WriteString(fmt.Sprintf("[%v]\n", group))
+		for _, node := range groups[group] {
+			sb.WriteString(node.Ip)
+			if node.SshPort != "" {
+				sb.WriteString(" ansible_port=" + node.SshPort)
+			}
+			writeIniVar(&sb, "gocd_remark", node.Remark)
+			writeIniVar(&sb, "gocd_credentials_id", node.CredentialsId)
+			if node.NumExecutors > 0 {
+				writeIniVar(&sb, "gocd_executors", strconv.Itoa(node.NumExecutors))
+			}
+			writeIniVar(&sb, "gocd_jvm_options", node.JvmOptions)
+			writeIniVar(&sb, "gocd_remote_fs", node.RemoteFs)
+
+			keys := make([]string, 0, len(node.Labels))
+			for key := range node.Labels {
+				if key != "group" {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				writeIniVar(&sb, key, node.Labels[key])
+			}
+			sb.WriteString("\n")
+		}
+		sb.WriteString("\n")
+	}
+	return []byte(sb.String())
+}
+
+func writeIniVar(sb *strings.Builder, key, value string) {
+	if value == "" {
+		return
+	}
+	if strings.ContainsAny(value, " \t") {
+		value = `"` + value + `"`
+	}
+	sb.WriteString(fmt.Sprintf(" %v=%v", key, value))
+}
@@ -0,0 +1,107 @@
+package gocd
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/liumingmin/gojenkins"
+)
+
+//节点描述中的结构化元数据 eg: gocd:{"env":"prod","ip":"10.0.0.1","remark":"api01","createdAt":"..."}
+const nodeMetaPrefix = "gocd:"
+
+//旧版本描述格式 env:(ip)remark
+var legacyNodeDescRegexp = regexp.MustCompile(`^(.*?):\((.*?)\)(.*)$`)
+
+type CdNodeMeta struct {
+	Env       string    `json:"env"`
+	Ip        string    `json:"ip"`
+	Remark    string    `json:"remark,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (m *CdNodeMeta) Encode() string {
+	bs, _ := json.Marshal(m)
+	return nodeMetaPrefix + string(bs)
+}
+
+//解析节点描述，legacy为true表示旧版本格式需要迁移
+func ParseCdNodeMeta(description string) (meta *CdNodeMeta, legacy bool, err error) {
+	description = strings.TrimSpace(description)
+	if strings.HasPrefix(description, nodeMetaPrefix) {
+		meta = &CdNodeMeta{}
+		if err = json.Unmarshal([]byte(description[len(nodeMetaPrefix):]), meta); err == nil {
+			return meta, false, nil
+		}
+	}
+
+	matches := legacyNodeDescRegexp.FindStringSubmatch(description)
+	if len(matches) == 4 {
+		return &CdNodeMeta{Env: matches[1], Ip: matches[2], Remark: matches[3]}, true, nil
+	}
+
+	return nil, false, fmt.Errorf("not gocd node description: %v", description)
+}
+
+type CdNode struct {
+	*gojenkins.Node
+
+	meta   *CdNodeMeta
+	legacy bool
+}
+
+func NewCdNode(node *gojenkins.Node) *CdNode {
+	cdNode := &CdNode{Node: node}
+	if node != nil && node.Raw != nil {
+		cdNode.meta, cdNode.legacy, _ = ParseCdNodeMeta(node.Raw.Description)
+	}
+	return cdNode
+}
+
+func (n *CdNode) Env() string {
+	if n.meta == nil {
+		return ""
+	}
+	return n.meta.Env
+}
+
+func (n *CdNode) Ip() string {
+	if n.meta == nil {
+		return ""
+	}
+	return n.meta.Ip
+}
+
+func (n *CdNode) Remark() string {
+	if n.meta == nil {
+		return ""
+	}
+	return n.meta.Remark
+}
+
+//旧版本或迁移节点创建时间未知，返回零值
+func (n *CdNode) CreatedAt() time.Time {
+	if n.meta == nil {
+		return time.Time{}
+	}
+	return n.meta.CreatedAt
+}
+
+func (n *CdNode) Labels() map[string]string {
+	return GetNodeLabels(n.Node)
+}
+
+func (n *CdNode) Meta() *CdNodeMeta {
+	return n.meta
+}
+
+func (n *CdNode) IsLegacy() bool {
+	return n.legacy
+}
+
+func (n *CdNode) isMaster() bool {
+	return n.Node != nil && n.Node.Raw != nil && n.Node.Raw.DisplayName == "master"
+}
@@ -0,0 +1,160 @@
+package gocd
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	selectorOpEquals    = "="
+	selectorOpNotEquals = "!="
+	selectorOpIn        = "in"
+	selectorOpNotIn     = "notin"
+	selectorOpExists    = "exists"
+	selectorOpNotExists = "!exists"
+)
+
+type cdLabelRequirement struct {
+	key    string
+	op     string
+	values []string
+}
+
+func (r *cdLabelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.op {
+	case selectorOpExists:
+		return ok
+	case selectorOpNotExists:
+		return !ok
+	case selectorOpEquals:
+		return ok && value == r.values[0]
+	case selectorOpNotEquals:
+		return !ok || value != r.values[0]
+	case selectorOpIn:
+		return ok && containsString(r.values, value)
+	case selectorOpNotIn:
+		return !ok || !containsString(r.values, value)
+	}
+	return false
+}
+
+//节点选择器，多个条件以逗号分隔，全部满足才匹配
+//支持: key=value key==value key!=value key in (a,b) key notin (a,b) key !key
+type CdNodeSelector []*cdLabelRequirement
+
+func ParseCdNodeSelector(selector string) (CdNodeSelector, error) {
+	nodeSelector := make(CdNodeSelector, 0)
+	for _, expr := range splitSelector(selector) {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			continue
+		}
+
+		requirement, err := parseLabelRequirement(expr)
+		if err != nil {
+			return nil, err
+		}
+		nodeSelector = append(nodeSelector, requirement)
+	}
+	return nodeSelector, nil
+}
+
+func (s CdNodeSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		if !requirement.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseLabelRequirement(expr string) (*cdLabelRequirement, error) {
+	if strings.HasPrefix(expr, "!") {
+		key := strings.TrimSpace(expr[1:])
+		if !isValidLabelToken(key) {
+			return nil, fmt.Errorf("invalid selector: %v", expr)
+		}
+		return &cdLabelRequirement{key: key, op: selectorOpNotExists}, nil
+	}
+
+	if idx := strings.Index(expr, "!="); idx > 0 {
+		return newEqualityRequirement(expr, expr[:idx], selectorOpNotEquals, expr[idx+2:])
+	}
+	if idx := strings.Index(expr, "=="); idx > 0 {
+		return newEqualityRequirement(expr, expr[:idx], selectorOpEquals, expr[idx+2:])
+	}
+	if idx := strings.Index(expr, "="); idx > 0 {
+		return newEqualityRequirement(expr, expr[:idx], selectorOpEquals, expr[idx+1:])
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) == 1 {
+		if !isValidLabelToken(fields[0]) {
+			return nil, fmt.Errorf("invalid selector: %v", expr)
+		}
+		return &cdLabelRequirement{key: fields[0], op: selectorOpExists}, nil
+	}
+
+	if len(fields) < 3 || (fields[1] != selectorOpIn && fields[1] != selectorOpNotIn) || !isValidLabelToken(fields[0]) {
+		return nil, fmt.Errorf("invalid selector: %v", expr)
+	}
+
+	setExpr := strings.TrimSpace(strings.Join(fields[2:], " "))
+	if !strings.HasPrefix(setExpr, "(") || !strings.HasSuffix(setExpr, ")") {
+		return nil, fmt.Errorf("invalid selector: %v", expr)
+	}
+
+	values := make([]string, 0)
+	for _, value := range strings.Split(setExpr[1:len(setExpr)-1], ",") {
+		value = strings.TrimSpace(value)
+		if !isValidLabelToken(value) {
+			return nil, fmt.Errorf("invalid selector: %v", expr)
+		}
+		values = append(values, value)
+	}
+	return &cdLabelRequirement{key: fields[0], op: fields[1], values: values}, nil
+}
+
+func newEqualityRequirement(expr, key, op, value string) (*cdLabelRequirement, error) {
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+	if !isValidLabelToken(key) || !isValidLabelToken(value) {
+		return nil, fmt.Errorf("invalid selector: %v", expr)
+	}
+	return &cdLabelRequirement{key: key, op: op, values: []string{value}}, nil
+}
+
+//按逗号切分，忽略括号内的逗号
+func splitSelector(selector string) []string {
+	exprs := make([]string, 0)
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				exprs = append(exprs, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(exprs, selector[start:])
+}
+
+//jenkins label以空格分隔，标签键值中不能有空白、逗号、括号和等号
+func isValidLabelToken(token string) bool {
+	return token != "" && !strings.ContainsAny(token, " \t\r\n,()=!&|<>'\"")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
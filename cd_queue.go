@@ -0,0 +1,248 @@
+package gocd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/liumingmin/gojenkins"
+	"github.com/liumingmin/goutils/log"
+)
+
+const (
+	queueRetryTimes        = 3
+	resolvedBuildTTL       = 24 * time.Hour // 构建号缓存时间
+	maxResolvedBuilds      = 1000           // 构建号缓存最大数量
+	deployIdScanBuildCount = 100            // 按队列id或部署id查找时扫描的最近构建数
+)
+
+//jenkins执行后几分钟会删除队列项
+var errQueueItemNotFound = errors.New("queue item not found")
+
+//jenkins队列项，gojenkins的taskResponse没有cancelled字段，且队列项过期后不返回错误
+type cdQueueItem struct {
+	ID           int64  `json:"id"`
+	Cancelled    bool   `json:"cancelled"`
+	Why          string `json:"why"`
+	InQueueSince int64  `json:"inQueueSince"` // ms
+	Executable   struct {
+		Number int64  `json:"number"`
+		URL    string `json:"url"`
+	} `json:"executable"`
+}
+
+type cdResolvedBuild struct {
+	item       *cdQueueItem
+	resolvedAt time.Time
+}
+
+//已解析的队列项缓存，只用于减少查询，过期或淘汰后从jenkins构建记录中重新查找
+type cdBuildCache struct {
+	mutex  sync.Mutex
+	builds map[string]*cdResolvedBuild
+}
+
+func (c *cdBuildCache) load(key string) *cdQueueItem {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if resolved, ok := c.builds[key]; ok && time.Since(resolved.resolvedAt) <= resolvedBuildTTL {
+		return resolved.item
+	}
+	return nil
+}
+
+//超过resolvedBuildTTL的删除，数量超过maxResolvedBuilds时删除最早的
+func (c *cdBuildCache) store(key string, item *cdQueueItem) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.builds == nil {
+		c.builds = make(map[string]*cdResolvedBuild)
+	}
+
+	now := time.Now()
+	c.builds[key] = &cdResolvedBuild{item: item, resolvedAt: now}
+
+	oldestKey, oldestAt := "", now
+	for buildKey, resolved := range c.builds {
+		if now.Sub(resolved.resolvedAt) > resolvedBuildTTL {
+			delete(c.builds, buildKey)
+			continue
+		}
+		if resolved.resolvedAt.Before(oldestAt) {
+			oldestKey, oldestAt = buildKey, resolved.resolvedAt
+		}
+	}
+	if len(c.builds) > maxResolvedBuilds && oldestKey != "" {
+		delete(c.builds, oldestKey)
+	}
+}
+
+func (j *CdServer) getQueueItem(ctx context.Context, taskId int64) (*cdQueueItem, error) {
+	item := &cdQueueItem{}
+	resp, err := j.jenkins.Requester.GetJSON(ctx, fmt.Sprintf("/queue/item/%d", taskId), item, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %v", errQueueItemNotFound, taskId)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get queue item failed: %v, status: %v", taskId, resp.StatusCode)
+	}
+	return item, nil
+}
+
+//网络错误等重试，队列项不存在时不重试
+func (j *CdServer) getQueueItemWithRetry(ctx context.Context, taskId int64) (*cdQueueItem, error) {
+	var err error
+	for i := 0; i < queueRetryTimes; i++ {
+		var item *cdQueueItem
+		item, err = j.getQueueItem(ctx, taskId)
+		if err == nil || errors.Is(err, errQueueItemNotFound) {
+			return item, err
+		}
+
+		log.Warn(ctx, "get queue item failed: %v, retry: %v, err: %v", taskId, i+1, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(i+1) * time.Second):
+		}
+	}
+	return nil, err
+}
+
+//查询部署结果时解析队列项对应的构建号，已开始构建的结果会缓存，获取构建后由setBuildDeployId显示部署id
+//队列项过期时按队列id或GOCD_DEPLOY_ID参数在最近构建中查找，jenkins构建记录中保存了两者，进程重启后仍可查找
+func (j *CdServer) resolveBuild(ctx context.Context, jobName string, taskId int64, deployId string) (*cdQueueItem, error) {
+	key := formatBuildKey(jobName, taskId)
+	if item := j.resolvedBuilds.load(key); item != nil {
+		return item, nil
+	}
+
+	item, err := j.getQueueItemWithRetry(ctx, taskId)
+	if err == nil {
+		if item.Cancelled || item.Executable.Number > 0 {
+			j.resolvedBuilds.store(key, item)
+		}
+		return item, nil
+	}
+	if !errors.Is(err, errQueueItemNotFound) {
+		return nil, err
+	}
+
+	buildNumber, err := j.findBuild(ctx, jobName, taskId, deployId)
+	if err != nil {
+		return nil, err
+	}
+
+	item = &cdQueueItem{ID: taskId}
+	item.Executable.Number = buildNumber
+	j.resolvedBuilds.store(key, item)
+	return item, nil
+}
+
+func (j *CdServer) findBuildByDeployId(ctx context.Context, jobName, deployId string) (int64, error) {
+	return j.findBuild(ctx, jobName, 0, deployId)
+}
+
+//taskId或deployId为空时不按其查找
+func (j *CdServer) findBuild(ctx context.Context, jobName string, taskId int64, deployId string) (int64, error) {
+	job, err := j.getJobByFullName(ctx, jobName)
+	if err != nil {
+		return 0, err
+	}
+
+	var builds struct {
+		Builds []struct {
+			Number  int64 `json:"number"`
+			QueueId int64 `json:"queueId"`
+			Actions []struct {
+				Parameters []struct {
+					Name  string      `json:"name"`
+					Value interface{} `json:"value"`
+				} `json:"parameters"`
+			} `json:"actions"`
+		} `json:"builds"`
+	}
+	tree := fmt.Sprintf("builds[number,queueId,actions[parameters[name,value]]]{0,%v}", deployIdScanBuildCount)
+	if _, err = j.jenkins.Requester.GetJSON(ctx, job.Base, &builds, map[string]string{"tree": tree}); err != nil {
+		log.Error(ctx, "get builds failed: %v, err: %v", jobName, err)
+		return 0, err
+	}
+
+	for _, build := range builds.Builds {
+		if taskId > 0 && build.QueueId == taskId {
+			return build.Number, nil
+		}
+		if deployId == "" {
+			continue
+		}
+		for _, action := range build.Actions {
+			for _, param := range action.Parameters {
+				if param.Name == deployIdParamName && param.Value == deployId {
+					return build.Number, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: %v, taskId: %v, deployId: %v", ErrBuildNotFound, jobName, taskId, deployId)
+}
+
+//在构建名称和描述中显示构建参数中的部署id，已有描述(已设置或已被取消)时不修改
+//每次获取构建时调用，不依赖调用方是否知道部署id和队列项是否过期
+func setBuildDeployId(ctx context.Context, build *gojenkins.Build) {
+	if build.Raw.Description != nil && fmt.Sprint(build.Raw.Description) != "" {
+		return
+	}
+
+	deployId := getBuildDeployId(build)
+	if deployId == "" {
+		return
+	}
+
+	description := deployIdParamName + "=" + deployId
+	config, _ := json.Marshal(map[string]string{
+		"displayName": fmt.Sprintf("#%v %v", build.GetBuildNumber(), deployId),
+		"description": description,
+	})
+	data := url.Values{}
+	data.Set("json", string(config))
+	_, err := build.Jenkins.Requester.Post(ctx, build.Base+"/configSubmit", bytes.NewBufferString(data.Encode()), nil, nil)
+	if err != nil {
+		log.Error(ctx, "set build display name failed: %v, err: %v", build.GetUrl(), err)
+		return
+	}
+	build.Raw.Description = description
+}
+
+func getBuildDeployId(build *gojenkins.Build) string {
+	for _, param := range build.GetParameters() {
+		if param.Name == deployIdParamName {
+			return param.Value
+		}
+	}
+	return ""
+}
+
+func formatBuildKey(jobName string, taskId int64) string {
+	return fmt.Sprintf("%v#%v", jobName, taskId)
+}
+
+func (j *CdServer) cancelQueueItem(ctx context.Context, taskId int64) error {
+	qr := map[string]string{"id": strconv.FormatInt(taskId, 10)}
+	_, err := j.jenkins.Requester.Post(ctx, "/queue/cancelItem", nil, nil, qr)
+	if err != nil {
+		log.Error(ctx, "cancel queue item failed: %v, err: %v", taskId, err)
+	}
+	return err
+}
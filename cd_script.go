@@ -2,34 +2,126 @@ package gocd
 
 import (
 	"bytes"
-	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
 	"text/template"
-
-	"github.com/liumingmin/goutils/log"
 )
 
 type CdScriptParamDef struct {
 	Name         string
 	Description  string
 	DefaultValue string
+	Type         string   // PARAM_TYPE_*，为空时为string
+	Required     bool     // 部署时必须有值(包括默认值)
+	Pattern      string   // 值需要完整匹配的正则
+	Choices      []string // choice类型的选项
 }
 
 type CdScript struct {
 	scriptParamDefs []*CdScriptParamDef
 	scriptTemplate  *template.Template
+	paramPatterns   map[string]*regexp.Regexp
+
+	scriptContent  string
+	scriptVersion  int
+	pipelineScript string       // pipeline job的groovy脚本
+	pipelineShells []string     // pipeline每个deploy阶段的sh内容
+	jobOption      *CdJobOption // 覆盖CdServer的job设置
+}
+
+//每次部署生成的唯一id，用于队列项过期后查找构建
+const deployIdParamName = "GOCD_DEPLOY_ID"
+
+//脚本操作，脚本不支持时以UNSUPPORTED_ACTION失败
+const actionParamName = "ACTION"
+
+const (
+	ACTION_DEPLOY    = "deploy"
+	ACTION_START     = "start"
+	ACTION_STOP      = "stop"
+	ACTION_RESTART   = "restart"
+	ACTION_STATUS    = "status"
+	ACTION_UNINSTALL = "uninstall"
+	ACTION_ROLLBACK  = "rollback" // 切换current到已有版本后重启，不下载程序包
+)
+
+var allActions = []string{ACTION_DEPLOY, ACTION_START, ACTION_STOP, ACTION_RESTART, ACTION_STATUS, ACTION_UNINSTALL, ACTION_ROLLBACK}
+
+//回滚目标版本，为空时回滚到current的上一个版本
+const rollbackParamName = "ROLLBACK_RELEASE"
 
-	scriptContent string
-	scriptVersion int
+//job描述中记录配置内容hash，内容变化时自动更新job配置
+const configHashPrefix = "gocd:hash="
+
+//job描述中记录环境，job名称按环境前缀无法区分prod和prod-eu环境
+const configEnvPrefix = "gocd:env="
+
+//格式: gocd:env=<env> gocd:hash=<hash>，env为空时只记录hash
+func formatJobDescription(env, hash string) string {
+	if env == "" {
+		return configHashPrefix + hash
+	}
+	return configEnvPrefix + env + " " + configHashPrefix + hash
 }
 
+//返回job描述中记录的环境，未记录时返回false
+func parseJobDescriptionEnv(description string) (string, bool) {
+	for _, field := range strings.Fields(description) {
+		if strings.HasPrefix(field, configEnvPrefix) {
+			return field[len(configEnvPrefix):], true
+		}
+	}
+	return "", false
+}
+
+//模板中必须输出{{.Description}}，否则job描述中没有hash，每次部署都会更新job配置
+var descriptionActionReg = regexp.MustCompile(`\{\{[^}]*\.Description\b[^}]*\}\}`)
+
 type cdScriptInstance struct {
-	ParameterDefs []*CdScriptParamDef
-	ScriptContent string
-	HostIp        string
+	ParameterDefs  []*CdScriptParamDef
+	ScriptContent  string
+	PipelineScript string
+	HostIp         string
+	Description    string        // 配置hash，模板中必须使用{{.Description}}
+	TimeoutMinutes int64         // 为0时不设置构建超时
+	LogRotator     *cdLogRotator // 为nil时不清理构建记录
 }
 
 func (t *CdScript) GetCdTaskScriptConfig(hostIp string) (string, error) {
-	nodeTaskDef := &cdScriptInstance{HostIp: hostIp, ParameterDefs: t.scriptParamDefs, ScriptContent: t.scriptContent}
+	config, _, err := t.getCdTaskScriptConfigWithHash(hostIp, "", nil)
+	return config, err
+}
+
+//defJobOption为CdServer的job设置，脚本的job设置优先
+func (t *CdScript) getCdTaskScriptConfigWithHash(hostIp, env string, defJobOption *CdJobOption) (string, string, error) {
+	jobOption := mergeJobOption(defJobOption, t.jobOption)
+	nodeTaskDef := &cdScriptInstance{HostIp: hostIp, ParameterDefs: t.scriptParamDefs, ScriptContent: t.scriptContent,
+		TimeoutMinutes: jobOption.timeoutMinutes(), LogRotator: jobOption.logRotator()}
+	if t.pipelineScript != "" {
+		nodeTaskDef.PipelineScript = renderPipelineScript(t.pipelineScript, hostIp, jobOption)
+	}
+	config, err := t.renderConfig(nodeTaskDef)
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.Sum256([]byte(config))
+	hash := hex.EncodeToString(sum[:])
+
+	nodeTaskDef.Description = formatJobDescription(env, hash)
+	config, err = t.renderConfig(nodeTaskDef)
+	if err != nil {
+		return "", "", err
+	}
+	return config, hash, nil
+}
+
+func (t *CdScript) renderConfig(nodeTaskDef *cdScriptInstance) (string, error) {
 	buf := new(bytes.Buffer)
 	err := t.scriptTemplate.Execute(buf, nodeTaskDef)
 	if err != nil {
@@ -38,11 +130,48 @@ func (t *CdScript) GetCdTaskScriptConfig(hostIp string) (string, error) {
 	return buf.String(), nil
 }
 
-func NewCdScript(scriptParamDefs []*CdScriptParamDef, scriptXmlTpl, scriptContent string, scriptVersion int) *CdScript {
-	tmpl, err := template.New("defaultTaskTpl").Parse(scriptXmlTpl)
+//检查渲染后的job配置是否为合法xml，脚本内容和pipeline每个阶段的sh是否能通过bash -n语法检查，需要本机安装bash
+func (t *CdScript) Validate() error {
+	config, err := t.GetCdTaskScriptConfig("127.0.0.1")
 	if err != nil {
-		log.Error(context.Background(), "parse tpl failed, err: %v", err)
-		return nil
+		return fmt.Errorf("%w: render config failed, err: %v", ErrInvalidScript, err)
+	}
+
+	var project struct {
+		XMLName xml.Name
+	}
+	if err = unmarshalJenkinsXml(config, &project); err != nil {
+		return fmt.Errorf("%w: config is not well-formed xml, err: %v", ErrInvalidScript, err)
+	}
+
+	if err = checkBashSyntax(t.scriptContent); err != nil {
+		return err
+	}
+	for idx, shell := range t.pipelineShells {
+		if err = checkBashSyntax(shell); err != nil {
+			return fmt.Errorf("pipeline stage %v: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+func checkBashSyntax(content string) error {
+	cmd := exec.Command("bash", "-n")
+	cmd.Stdin = strings.NewReader(content)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: bash -n failed: %v, err: %v", ErrInvalidScript, strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+//scriptVersion可选，脚本内容变化时job配置会按内容hash自动更新
+func NewCdScript(scriptParamDefs []*CdScriptParamDef, scriptXmlTpl, scriptContent string, scriptVersion int) (*CdScript, error) {
+	tmpl, err := template.New("defaultTaskTpl").Funcs(template.FuncMap{"paramXml": renderParamDefXml, "xml": escapeXmlText}).Parse(scriptXmlTpl)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parse tpl failed, err: %v", ErrInvalidScript, err)
+	}
+	if !descriptionActionReg.MatchString(scriptXmlTpl) {
+		return nil, fmt.Errorf("%w: tpl must reference {{.Description}}", ErrInvalidScript)
 	}
 
 	baseScriptParamDefs := make([]*CdScriptParamDef, 0)
@@ -55,47 +184,57 @@ func NewCdScript(scriptParamDefs []*CdScriptParamDef, scriptXmlTpl, scriptConten
 	})
 	baseScriptParamDefs = append(baseScriptParamDefs, &CdScriptParamDef{
 		Name: "S3ENV_VAR",
+		Type: PARAM_TYPE_PASSWORD,
 	})
+	baseScriptParamDefs = append(baseScriptParamDefs, &CdScriptParamDef{
+		Name: deployIdParamName,
+	})
+	baseScriptParamDefs = append(baseScriptParamDefs, &CdScriptParamDef{
+		Name:         actionParamName,
+		DefaultValue: ACTION_DEPLOY,
+		Type:         PARAM_TYPE_CHOICE,
+		Choices:      allActions,
+	})
+
+	allScriptParamDefs := append(baseScriptParamDefs, scriptParamDefs...)
+	paramPatterns, err := compileParamPatterns(allScriptParamDefs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidScript, err)
+	}
 
 	return &CdScript{
-		scriptParamDefs: append(baseScriptParamDefs, scriptParamDefs...),
+		scriptParamDefs: allScriptParamDefs,
 		scriptTemplate:  tmpl,
+		paramPatterns:   paramPatterns,
 		scriptContent:   scriptContent,
 		scriptVersion:   scriptVersion,
+	}, nil
+}
+
+//内置脚本使用，创建失败时panic
+func MustCdScript(cdScript *CdScript, err error) *CdScript {
+	if err != nil {
+		panic(err)
 	}
+	return cdScript
 }
 
 func NewDefaultCdScript() *CdScript {
-	scriptParamDefs := make([]*CdScriptParamDef, 0)
-	paramNames := []string{"PKG_URL", "TARGET_PATH", "RUN_CMD", "ENV_VAR"}
-	for _, paramName := range paramNames {
-		scriptParamDefs = append(scriptParamDefs, &CdScriptParamDef{
-			Name: paramName,
-		})
-	}
-	return NewCdScript(scriptParamDefs, DefaultXmlTpl, DefaultTaskScript, defaultTaskScriptVer)
+	return MustCdScript(NewDefaultCdScriptBuilder().Build())
 }
 
 const DefaultXmlTpl = `<?xml version='1.1' encoding='UTF-8'?>
 <project>
   <actions/>
-  <description></description>
+  <description>{{.Description}}</description>
   <keepDependencies>false</keepDependencies>
   <properties>
     <com.sonyericsson.rebuild.RebuildSettings plugin="rebuild@1.31">
       <autoRebuild>false</autoRebuild>
       <rebuildDisabled>false</rebuildDisabled>
-    </com.sonyericsson.rebuild.RebuildSettings>
+    </com.sonyericsson.rebuild.RebuildSettings>` + jobLogRotatorXmlTpl + `
     <hudson.model.ParametersDefinitionProperty>
-      <parameterDefinitions>
-        {{range .ParameterDefs}}
-			<hudson.model.StringParameterDefinition>
-			  <name>{{.Name}}</name>
-			  <description>{{.Description}}</description>
-			  <defaultValue>{{.DefaultValue}}</defaultValue>
-			  <trim>true</trim>
-			</hudson.model.StringParameterDefinition>
-		{{end}}
+      <parameterDefinitions>{{range .ParameterDefs}}{{paramXml .}}{{end}}
       </parameterDefinitions>
     </hudson.model.ParametersDefinitionProperty>
   </properties>
@@ -113,34 +252,149 @@ const DefaultXmlTpl = `<?xml version='1.1' encoding='UTF-8'?>
     </hudson.tasks.Shell>
   </builders>
   <publishers/>
-  <buildWrappers/>
+  <buildWrappers>{{if .TimeoutMinutes}}
+    <hudson.plugins.build__timeout.BuildTimeoutWrapper plugin="build-timeout">
+      <strategy class="hudson.plugins.build_timeout.impl.AbsoluteTimeOutStrategy">
+        <timeoutMinutes>{{.TimeoutMinutes}}</timeoutMinutes>
+      </strategy>
+      <operationList>
+        <hudson.plugins.build__timeout.operations.AbortOperation/>
+      </operationList>
+    </hudson.plugins.build__timeout.BuildTimeoutWrapper>{{end}}
+  </buildWrappers>
 </project>`
 
 const defaultTaskScriptVer = 1
 
-const DefaultTaskScript = `#!/bin/bash -il
-#jenkins内置参数
-#NODE_NAME
+var DefaultTaskScript = NewDefaultCdScriptBuilder().Render()
+
+//部署脚本公共函数: 阶段标记、失败码和退出标记
+const taskScriptFuncs = `#阶段标记 gocd:stage:<name>:<ms>，退出标记 gocd:exit:<code>:<ms>
+gocd_stage() {
+    echo "gocd:stage:$1:$(date +%s%3N)"
+}
+trap 'echo "gocd:exit:$?:$(date +%s%3N)"' EXIT
+
+#失败码 gocd:fail:<code>:<detail>
+gocd_fail() {
+    echo "gocd:fail:$1:$2"
+    exit ${3:-1}
+}
+
+#服务状态 gocd:status:<running|stopped|unknown>:<detail>
+gocd_status() {
+    echo "gocd:status:$1:$2"
+}
+
+ACTION=${ACTION:-deploy}
+echo "gocd:deploy:${GOCD_DEPLOY_ID}:${ACTION}"
+`
+
+//程序包阶段使用的变量和函数
+//程序包解压到TARGET_PATH/releases/<部署id>，TARGET_PATH/current链接到当前版本
+const taskScriptPackagePrelude = `S3GET_PATH="/tmp/s3get"
+RELEASE_DIR=${TARGET_PATH}/releases/${GOCD_DEPLOY_ID:-$(date +%Y%m%d%H%M%S-%N)}
+CURRENT_LINK=${TARGET_PATH}/current
+
+SUDO=""
+if [[ $(id -u) -ne 0 ]]; then
+    SUDO="sudo -n"
+fi
+
+#执行程序包中的钩子脚本 gocd/<name>.sh，工作目录为程序包目录，不存在时跳过
+#gocd_run_hook <name> <pkg dir>
+gocd_run_hook() {
+    HOOK_FILE=$2/gocd/$1.sh
+    if [[ "${HOOKS_ENABLED}" == "false" || ! -f ${HOOK_FILE} ]]; then
+        return 0
+    fi
+
+    echo "gocd: run hook $1.sh"
+    (
+        cd $2
+        if [[ -n "${ENV_VAR}" ]]; then
+            export ${ENV_VAR}
+        fi
+        /bin/bash ${HOOK_FILE}
+    )
+    EXIT_CODE=$?
+    if [[ ${EXIT_CODE} -ne 0 ]]; then
+        gocd_fail HOOK_FAILED "$1.sh" ${EXIT_CODE}
+    fi
+}
+
+#原子切换current到版本目录，先创建临时链接再rename
+#gocd_switch_release <release>
+gocd_switch_release() {
+    ln -sfn releases/$1 ${CURRENT_LINK}.tmp && mv -Tf ${CURRENT_LINK}.tmp ${CURRENT_LINK}
+}
+
+#已完成安装的版本，按部署id(时间)排序
+gocd_list_releases() {
+    for RELEASE in $(ls -1 ${TARGET_PATH}/releases 2>/dev/null | sort); do
+        if [[ -f ${TARGET_PATH}/releases/${RELEASE}/.gocd_released ]]; then
+            echo ${RELEASE}
+        fi
+    done
+}
+
+#保留最近KEEP_RELEASES个版本和current版本，删除失败部署的残留
+gocd_clean_releases() {
+    CURRENT_RELEASE=$(basename "$(readlink ${CURRENT_LINK})")
+    KEEP=$(gocd_list_releases | tail -n ${KEEP_RELEASES:-5})
+    for RELEASE in $(ls -1 ${TARGET_PATH}/releases); do
+        if [[ "${RELEASE}" != "${CURRENT_RELEASE}" ]] && ! echo "${KEEP}" | grep -qx "${RELEASE}"; then
+            rm -rf ${TARGET_PATH}/releases/${RELEASE}
+        fi
+    done
+}
+
+#回滚到ROLLBACK_RELEASE，为空时回滚到current的上一个版本
+gocd_rollback() {
+    CURRENT_RELEASE=$(basename "$(readlink ${CURRENT_LINK})")
+    TARGET_RELEASE=${ROLLBACK_RELEASE}
+    if [[ -z "${TARGET_RELEASE}" ]]; then
+        TARGET_RELEASE=$(gocd_list_releases | grep -x -B1 "${CURRENT_RELEASE}" | head -n 1)
+    fi
+    if [[ -z "${TARGET_RELEASE}" || "${TARGET_RELEASE}" == "${CURRENT_RELEASE}" || ! -f ${TARGET_PATH}/releases/${TARGET_RELEASE}/.gocd_released ]]; then
+        gocd_fail RELEASE_NOT_FOUND "${TARGET_RELEASE:-previous of ${CURRENT_RELEASE}}"
+    fi
 
-#固定参数
-#RUN_ENV 运行环境
-#S3GET_URL s3get工具下载地址
-#S3ENV_VAR s3get环境变量
+    echo "gocd: rollback ${CURRENT_RELEASE} -> ${TARGET_RELEASE}"
+    gocd_switch_release ${TARGET_RELEASE}
+    if [[ $? -ne 0 ]]; then
+        gocd_fail RUN_CMD_FAILED "switch ${CURRENT_LINK}"
+    fi
+}
 
-#服务参数
-#PKG_URL 程序包s3 key
-#TARGET_PATH 程序目录
-#RUN_CMD 运行脚本
-#ENV_VAR 环境变量
+#卸载时删除程序目录，只删除gocd部署的目录(有releases目录和current链接)，部署时不需要sudo写入，删除时也不使用sudo
+gocd_remove_target() {
+    if [[ -z "${TARGET_PATH}" || ! -d "${TARGET_PATH}/releases" || ! -L "${TARGET_PATH}/current" ]]; then
+        gocd_fail INVALID_TARGET "not gocd target ${TARGET_PATH}"
+    fi
+    rm -rf -- "${TARGET_PATH}"
+}
+`
 
-#变量
-S3GET_PATH="/tmp/s3get"
-mkdir -p /tmp
+//程序包钩子: pre_install在切换版本前执行，post_install在切换后执行，pre_start在启动前执行
+func newPackageParamDefs() []*CdScriptParamDef {
+	return []*CdScriptParamDef{
+		{Name: "HOOKS_ENABLED", Description: "是否执行程序包中的gocd/*.sh钩子", Type: PARAM_TYPE_BOOL, DefaultValue: "true"},
+		{Name: "KEEP_RELEASES", Description: "保留的版本数", DefaultValue: "5", Pattern: `[1-9][0-9]*`},
+		{Name: rollbackParamName, Description: "回滚目标版本，为空时为上一个版本", Pattern: `[A-Za-z0-9_.-]*`},
+	}
+}
+
+//下载s3get工具和程序包，校验解压到新版本目录后切换current，前后执行程序包中的钩子
+func newPackageStages() []*CdScriptStage {
+	return []*CdScriptStage{
+		{Name: STAGE_FETCH_TOOL, FailCode: FAIL_CODE_PACKAGE_DOWNLOAD, Content: `    if [[ -f ${S3GET_PATH} ]]; then
+        return 0
+    fi
 
-#下载s3工具
-if [[ ! -f ${S3GET_PATH} ]]; then
     echo "gocd: downloading s3get..."
-     ( flock -x 42;
+    mkdir -p $(dirname ${S3GET_PATH})
+    ( flock -x 42;
       if [[ ! -f ${S3GET_PATH} ]]; then
         curl -s --insecure ${S3GET_URL} -o ${S3GET_PATH}.tgz
         tar -xzf ${S3GET_PATH}.tgz -C $(dirname ${S3GET_PATH}.tgz)
@@ -154,32 +408,78 @@ if [[ ! -f ${S3GET_PATH} ]]; then
         fi
         chmod +x ${S3GET_PATH}
       fi
-     ) 42>"${S3GET_PATH}.lock"
-fi
-
+    ) 42>"${S3GET_PATH}.lock"`},
+		{Name: STAGE_DOWNLOAD, FailCode: FAIL_CODE_PACKAGE_DOWNLOAD, Content: `    mkdir -p ${RELEASE_DIR}
 
-mkdir -p ${TARGET_PATH}
-DATENAME=$(date +%Y%m%d%H%M%S-%N)
-TMP_PKG_DIR=${TARGET_PATH}/tmppkg${DATENAME}
-mkdir ${TMP_PKG_DIR}
+    export ${S3ENV_VAR}
+    ${S3GET_PATH} ${PKG_URL} ${RELEASE_DIR}.tgz
+    if [[ $? -ne 0 ]]; then
+        gocd_fail PACKAGE_DOWNLOAD "${PKG_URL}"
+    fi`},
+		{Name: STAGE_VERIFY, FailCode: FAIL_CODE_PACKAGE_DOWNLOAD, Content: `    gzip -t ${RELEASE_DIR}.tgz
+    if [[ $? -ne 0 ]]; then
+        rm -rf ${RELEASE_DIR} ${RELEASE_DIR}.tgz
+        gocd_fail PACKAGE_DOWNLOAD "corrupted ${PKG_URL}"
+    fi`},
+		{Name: STAGE_EXTRACT, FailCode: FAIL_CODE_PACKAGE_DOWNLOAD, Content: `    tar -xzf ${RELEASE_DIR}.tgz -C ${RELEASE_DIR}
+    if [[ $? -ne 0 ]]; then
+        echo "gocd: extract program tgz failed ${PKG_URL}..."
+        gocd_fail PACKAGE_DOWNLOAD "${PKG_URL}"
+    fi
+    rm -f ${RELEASE_DIR}.tgz`},
+		{Name: STAGE_PRE_HOOK, FailCode: FAIL_CODE_HOOK_FAILED, Content: `    gocd_run_hook pre_install ${RELEASE_DIR}`},
+		{Name: STAGE_SYNC, Content: `    touch ${RELEASE_DIR}/.gocd_released
+    gocd_switch_release $(basename ${RELEASE_DIR})
+    if [[ $? -ne 0 ]]; then
+        gocd_fail RUN_CMD_FAILED "switch ${CURRENT_LINK}"
+    fi
+    gocd_clean_releases`},
+		{Name: STAGE_POST_HOOK, FailCode: FAIL_CODE_HOOK_FAILED, Content: `    gocd_run_hook post_install ${CURRENT_LINK}`},
+		{Name: STAGE_PRE_START, FailCode: FAIL_CODE_HOOK_FAILED, Content: `    gocd_run_hook pre_start ${CURRENT_LINK}`},
+	}
+}
 
-#下载程序包
-export ${S3ENV_VAR}
-${S3GET_PATH} ${PKG_URL} ${TMP_PKG_DIR}.tgz
-tar -xzf ${TMP_PKG_DIR}.tgz -C ${TMP_PKG_DIR}
-EXIT_CODE=$?
-if [[ EXIT_CODE -ne 0 ]]; then
-	echo "gocd: download program tgz failed ${PROG_URL}..."
-	exit 1
-fi
-rm -f ${TMP_PKG_DIR}.tgz
+//默认脚本按pid文件停止和查询状态，pid文件在TARGET_PATH下，切换版本后仍有效
+const taskScriptPidPrelude = `
+GOCD_PID_FILE=${TARGET_PATH}/gocd.pid
+export GOCD_PID_FILE
 
-#同步程序包
-rsync -av ${TMP_PKG_DIR}/  ${TARGET_PATH}
-rm -rf ${TMP_PKG_DIR}
+gocd_pid_status() {
+    if [[ ! -f "${GOCD_PID_FILE}" ]]; then
+        gocd_status unknown "no pid file ${GOCD_PID_FILE}"
+    elif kill -0 $(cat "${GOCD_PID_FILE}") 2>/dev/null; then
+        gocd_status running "pid $(cat "${GOCD_PID_FILE}")"
+    else
+        gocd_status stopped "pid $(cat "${GOCD_PID_FILE}") exited"
+    fi
+}
 
-cd ${TARGET_PATH}
+#先kill，STOP_WAIT_SECONDS(默认30)秒后仍未退出时kill -9
+gocd_stop_pid() {
+    if [[ ! -f "${GOCD_PID_FILE}" ]]; then
+        gocd_fail UNSUPPORTED_ACTION "no pid file ${GOCD_PID_FILE}, RUN_CMD should write pid to GOCD_PID_FILE"
+    fi
 
-export ${ENV_VAR}
-/bin/bash ${RUN_CMD}
+    PID=$(cat "${GOCD_PID_FILE}")
+    if kill -0 ${PID} 2>/dev/null; then
+        kill ${PID}
+        for i in $(seq 1 ${STOP_WAIT_SECONDS:-30}); do
+            kill -0 ${PID} 2>/dev/null || break
+            sleep 1
+        done
+        if kill -0 ${PID} 2>/dev/null; then
+            kill -9 ${PID}
+        fi
+    fi
+    rm -f "${GOCD_PID_FILE}"
+}
 `
+
+const defaultRunStage = `    cd ${CURRENT_LINK}
+
+    export ${ENV_VAR}
+    /bin/bash ${RUN_CMD}
+    EXIT_CODE=$?
+    if [[ EXIT_CODE -ne 0 ]]; then
+        gocd_fail RUN_CMD_FAILED "${RUN_CMD}" ${EXIT_CODE}
+    fi`
@@ -0,0 +1,312 @@
+package gocd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//部署阶段名称，部署时按顺序执行，输出 gocd:stage:<name> 标记
+const (
+	STAGE_FETCH_TOOL   = "fetch_tool"
+	STAGE_DOWNLOAD     = "download"
+	STAGE_VERIFY       = "verify"
+	STAGE_EXTRACT      = "extract"
+	STAGE_PRE_HOOK     = "pre_hook"
+	STAGE_SYNC         = "sync"    // 切换current到新版本
+	STAGE_INSTALL      = "install" // 生成systemd unit、supervisor program配置
+	STAGE_POST_HOOK    = "post_hook"
+	STAGE_PRE_START    = "pre_start"
+	STAGE_RUN          = "run"
+	STAGE_HEALTH_CHECK = "health_check"
+)
+
+var stageNameReg = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+//部署阶段，Content在函数gocd_stage_<name>中执行，最后一条命令返回非0时以FailCode失败
+//阶段内可直接调用gocd_fail指定失败码和详情
+type CdScriptStage struct {
+	Name     string
+	FailCode string // 为空时为RUN_CMD_FAILED
+	Content  string // 为空时跳过此阶段
+
+	Timeout time.Duration // 仅pipeline，阶段超时
+	Retry   int           // 仅pipeline，阶段失败重试次数
+}
+
+type cdScriptAction struct {
+	pattern string // case分支，如 start|stop|restart
+	content string
+}
+
+//按阶段组合部署脚本，服务可插入、替换或删除阶段后Build
+type CdScriptBuilder struct {
+	paramDefs []*CdScriptParamDef
+	xmlTpl    string
+	version   int
+	prelude   string // 公共函数后、ACTION分支前执行，定义变量和函数
+	stages    []*CdScriptStage
+	actions   []*cdScriptAction
+	pipeline  *CdPipelineOption // 不为空时生成pipeline job
+	jobOption *CdJobOption
+	err       error
+}
+
+func NewCdScriptBuilder(paramDefs []*CdScriptParamDef) *CdScriptBuilder {
+	return &CdScriptBuilder{paramDefs: paramDefs, xmlTpl: DefaultXmlTpl}
+}
+
+//默认脚本: 下载程序包同步到TARGET_PATH后前台运行RUN_CMD
+//RUN_CMD将后台进程pid写入GOCD_PID_FILE后支持stop、restart和status，未写入时stop失败，status为unknown
+func NewDefaultCdScriptBuilder() *CdScriptBuilder {
+	builder := NewCdScriptBuilder([]*CdScriptParamDef{
+		{Name: "PKG_URL", Description: "程序包s3 key", Required: true},
+		{Name: "TARGET_PATH", Description: "程序目录", Required: true},
+		{Name: "RUN_CMD", Description: "运行脚本，后台进程pid写入${GOCD_PID_FILE}", Required: true},
+		{Name: "ENV_VAR", Description: "环境变量"},
+	})
+	builder.AddParamDef(newPackageParamDefs()...)
+	builder.Version(defaultTaskScriptVer).Prelude(taskScriptPackagePrelude + taskScriptPidPrelude)
+	builder.AddStage(newPackageStages()...)
+	builder.AddStage(&CdScriptStage{Name: STAGE_RUN, Content: defaultRunStage})
+
+	//前台运行，start和rollback不下载程序包
+	builder.Action(ACTION_START, "gocd_run_stage "+STAGE_PRE_START+" "+FAIL_CODE_HOOK_FAILED+"\ngocd_run_stage "+STAGE_RUN+" "+FAIL_CODE_RUN_CMD_FAILED)
+	builder.Action(ACTION_STOP, "gocd_stage stop\ngocd_stop_pid")
+	builder.Action(ACTION_RESTART, "gocd_stage restart\ngocd_stop_pid\ngocd_run_stage "+STAGE_PRE_START+" "+FAIL_CODE_HOOK_FAILED+"\ngocd_run_stage "+STAGE_RUN+" "+FAIL_CODE_RUN_CMD_FAILED)
+	builder.Action(ACTION_STATUS, "gocd_pid_status")
+	builder.Action(ACTION_ROLLBACK, "gocd_stage rollback\ngocd_rollback\ngocd_run_stage "+STAGE_PRE_START+" "+FAIL_CODE_HOOK_FAILED+"\ngocd_run_stage "+STAGE_RUN+" "+FAIL_CODE_RUN_CMD_FAILED)
+	builder.Action(ACTION_UNINSTALL, "gocd_stage uninstall\ngocd_remove_target")
+	return builder
+}
+
+func (b *CdScriptBuilder) Version(version int) *CdScriptBuilder {
+	b.version = version
+	return b
+}
+
+func (b *CdScriptBuilder) XmlTpl(xmlTpl string) *CdScriptBuilder {
+	b.xmlTpl = xmlTpl
+	return b
+}
+
+//job构建超时和构建记录保留设置，不为0的值覆盖CdServerJobOption，JOB_OPTION_UNLIMITED表示不限制
+func (b *CdScriptBuilder) JobOption(option *CdJobOption) *CdScriptBuilder {
+	b.jobOption = option
+	return b
+}
+
+func (b *CdScriptBuilder) AddParamDef(paramDefs ...*CdScriptParamDef) *CdScriptBuilder {
+	b.paramDefs = append(b.paramDefs, paramDefs...)
+	return b
+}
+
+func (b *CdScriptBuilder) Prelude(prelude string) *CdScriptBuilder {
+	b.prelude = prelude
+	return b
+}
+
+//设置非deploy操作的脚本，执行后退出，相同分支时替换
+func (b *CdScriptBuilder) Action(pattern, content string) *CdScriptBuilder {
+	if pattern == ACTION_DEPLOY {
+		b.setErr(fmt.Errorf("action %v is composed of stages", pattern))
+		return b
+	}
+
+	for _, action := range b.actions {
+		if action.pattern == pattern {
+			action.content = content
+			return b
+		}
+	}
+	b.actions = append(b.actions, &cdScriptAction{pattern: pattern, content: content})
+	return b
+}
+
+func (b *CdScriptBuilder) AddStage(stages ...*CdScriptStage) *CdScriptBuilder {
+	for _, stage := range stages {
+		b.insertStage(len(b.stages), stage)
+	}
+	return b
+}
+
+func (b *CdScriptBuilder) InsertStageBefore(name string, stage *CdScriptStage) *CdScriptBuilder {
+	idx := b.indexStage(name)
+	if idx < 0 {
+		b.setErr(fmt.Errorf("stage not found: %v", name))
+		return b
+	}
+	b.insertStage(idx, stage)
+	return b
+}
+
+func (b *CdScriptBuilder) InsertStageAfter(name string, stage *CdScriptStage) *CdScriptBuilder {
+	idx := b.indexStage(name)
+	if idx < 0 {
+		b.setErr(fmt.Errorf("stage not found: %v", name))
+		return b
+	}
+	b.insertStage(idx+1, stage)
+	return b
+}
+
+//按名称替换阶段
+func (b *CdScriptBuilder) ReplaceStage(stage *CdScriptStage) *CdScriptBuilder {
+	idx := b.indexStage(stage.Name)
+	if idx < 0 {
+		b.setErr(fmt.Errorf("stage not found: %v", stage.Name))
+		return b
+	}
+	b.stages[idx] = stage
+	return b
+}
+
+func (b *CdScriptBuilder) RemoveStage(name string) *CdScriptBuilder {
+	idx := b.indexStage(name)
+	if idx < 0 {
+		b.setErr(fmt.Errorf("stage not found: %v", name))
+		return b
+	}
+	b.stages = append(b.stages[:idx], b.stages[idx+1:]...)
+	return b
+}
+
+func (b *CdScriptBuilder) GetStage(name string) *CdScriptStage {
+	if idx := b.indexStage(name); idx >= 0 {
+		return b.stages[idx]
+	}
+	return nil
+}
+
+func (b *CdScriptBuilder) StageNames() []string {
+	names := make([]string, 0, len(b.stages))
+	for _, stage := range b.stages {
+		names = append(names, stage.Name)
+	}
+	return names
+}
+
+func (b *CdScriptBuilder) insertStage(idx int, stage *CdScriptStage) {
+	if !stageNameReg.MatchString(stage.Name) {
+		b.setErr(fmt.Errorf("invalid stage name: %v", stage.Name))
+		return
+	}
+	if b.indexStage(stage.Name) >= 0 {
+		b.setErr(fmt.Errorf("duplicate stage: %v", stage.Name))
+		return
+	}
+
+	b.stages = append(b.stages, nil)
+	copy(b.stages[idx+1:], b.stages[idx:])
+	b.stages[idx] = stage
+}
+
+func (b *CdScriptBuilder) indexStage(name string) int {
+	for idx, stage := range b.stages {
+		if stage.Name == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+//只保留第一个错误，Build时返回
+func (b *CdScriptBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+//生成部署脚本: 参数说明、公共函数、阶段函数、ACTION分支，deploy时按顺序执行阶段
+func (b *CdScriptBuilder) Render() string {
+	var sb strings.Builder
+	sb.WriteString(taskScriptHeader)
+	sb.WriteString("\n#服务参数\n")
+	for _, paramDef := range b.paramDefs {
+		sb.WriteString(strings.TrimSpace("#"+paramDef.Name+" "+paramDef.Description) + "\n")
+	}
+
+	sb.WriteString("\n" + taskScriptFuncs + "\n" + taskScriptRunStage)
+	for _, stage := range b.stages {
+		if stage.Content == "" {
+			continue
+		}
+		sb.WriteString(renderStageFunc(stage))
+	}
+
+	if b.prelude != "" {
+		sb.WriteString("\n" + strings.TrimRight(b.prelude, "\n") + "\n")
+	}
+
+	sb.WriteString("\ncase ${ACTION} in\n    " + ACTION_DEPLOY + ")\n        ;;\n")
+	for _, action := range b.actions {
+		sb.WriteString("    " + action.pattern + ")\n")
+		for _, line := range strings.Split(strings.TrimRight(action.content, "\n"), "\n") {
+			sb.WriteString(strings.TrimRight("        "+line, " ") + "\n")
+		}
+		sb.WriteString("        exit 0\n        ;;\n")
+	}
+	sb.WriteString("    *)\n        gocd_fail " + FAIL_CODE_UNSUPPORTED_ACTION + " \"${ACTION}\"\n        ;;\nesac\n\n")
+
+	for _, stage := range b.stages {
+		if stage.Content == "" {
+			continue
+		}
+		sb.WriteString(renderRunStage(stage))
+	}
+	return sb.String()
+}
+
+func (b *CdScriptBuilder) Build() (*CdScript, error) {
+	if b.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidScript, b.err)
+	}
+
+	cdScript, err := NewCdScript(b.paramDefs, b.xmlTpl, b.Render(), b.version)
+	if err != nil {
+		return nil, err
+	}
+	if b.pipeline != nil {
+		cdScript.pipelineScript = b.RenderPipeline()
+		cdScript.pipelineShells = b.renderPipelineShells()
+	}
+	cdScript.jobOption = b.jobOption
+	return cdScript, nil
+}
+
+func renderStageFunc(stage *CdScriptStage) string {
+	return fmt.Sprintf("\ngocd_stage_%v() {\n%v\n}\n", stage.Name, strings.TrimRight(stage.Content, "\n"))
+}
+
+func renderRunStage(stage *CdScriptStage) string {
+	failCode := stage.FailCode
+	if failCode == "" {
+		failCode = FAIL_CODE_RUN_CMD_FAILED
+	}
+	return fmt.Sprintf("gocd_run_stage %v %v\n", stage.Name, failCode)
+}
+
+const taskScriptHeader = `#!/bin/bash -il
+#jenkins内置参数
+#NODE_NAME
+
+#固定参数
+#RUN_ENV 运行环境
+#S3GET_URL s3get工具下载地址
+#S3ENV_VAR s3get环境变量
+#GOCD_DEPLOY_ID 部署id
+#ACTION 操作 deploy start stop restart status uninstall rollback
+`
+
+//执行阶段函数，返回非0时以阶段失败码退出
+const taskScriptRunStage = `#gocd_run_stage <name> <fail code>
+gocd_run_stage() {
+    gocd_stage $1
+    gocd_stage_$1
+    EXIT_CODE=$?
+    if [[ ${EXIT_CODE} -ne 0 ]]; then
+        gocd_fail $2 "$1" ${EXIT_CODE}
+    fi
+}
+`
@@ -0,0 +1,89 @@
+package gocd
+
+//以docker或podman容器运行服务，镜像替代程序包，不需要s3get
+func NewDockerCdScript() *CdScript {
+	return MustCdScript(NewDockerCdScriptBuilder().Build())
+}
+
+func NewDockerCdScriptBuilder() *CdScriptBuilder {
+	builder := NewCdScriptBuilder([]*CdScriptParamDef{
+		{Name: "IMAGE", Description: "镜像", Required: true},
+		{Name: "CONTAINER_NAME", Description: "容器名称", Required: true, Pattern: `[A-Za-z0-9][A-Za-z0-9_.-]*`},
+		{Name: "DOCKER_ARGS", Description: "docker run其他参数"},
+		{Name: "RUN_CMD", Description: "容器运行命令，为空时使用镜像默认命令"},
+		{Name: "ENV_VAR", Description: "环境变量"},
+	})
+	builder.Version(dockerTaskScriptVer).Prelude(dockerScriptPrelude)
+	builder.AddStage(&CdScriptStage{Name: STAGE_DOWNLOAD, FailCode: FAIL_CODE_PACKAGE_DOWNLOAD, Content: `    ${DOCKER} pull ${IMAGE}`})
+	builder.AddStage(&CdScriptStage{Name: STAGE_RUN, Content: dockerRunStage})
+	builder.AddStage(&CdScriptStage{Name: STAGE_HEALTH_CHECK, FailCode: FAIL_CODE_HEALTH_CHECK, Content: dockerHealthCheckStage})
+
+	builder.Action("start|stop|restart", `gocd_stage ${ACTION}
+${DOCKER} ${ACTION} ${CONTAINER_NAME}
+if [[ $? -ne 0 ]]; then
+    gocd_fail RUN_CMD_FAILED "${DOCKER} ${ACTION} ${CONTAINER_NAME}"
+fi`)
+	builder.Action(ACTION_STATUS, `STATE=$(${DOCKER} inspect -f '{{.State.Status}} {{.State.StartedAt}} {{.Config.Image}}' ${CONTAINER_NAME} 2>&1)
+if [[ "${STATE}" == running* ]]; then
+    gocd_status running "${STATE}"
+else
+    gocd_status stopped "${STATE}"
+fi`)
+	builder.Action(ACTION_UNINSTALL, `gocd_stage uninstall
+${DOCKER} rm -f ${CONTAINER_NAME}`)
+	return builder
+}
+
+type DockerCdService struct {
+	DefaultCdService
+}
+
+//dockerArgs为docker run的其他参数，如端口和目录映射: -p 8080:8080 -v /data:/data
+//runCmd为空时使用镜像默认命令
+func NewDockerCdService(name, image, dockerArgs, runCmd string, envVar map[string]string) CdService {
+	return &DockerCdService{
+		DefaultCdService: DefaultCdService{
+			name: name,
+			params: map[string]string{
+				"IMAGE":          image,
+				"CONTAINER_NAME": name,
+				"DOCKER_ARGS":    dockerArgs,
+				"RUN_CMD":        runCmd,
+				"ENV_VAR":        formatEnvVar(envVar),
+			},
+			cdScript: NewDockerCdScript(),
+		},
+	}
+}
+
+func (t *DockerCdService) UpdateImage(image string) {
+	t.params["IMAGE"] = image
+}
+
+const dockerTaskScriptVer = 1
+
+//优先使用docker，没有时使用podman
+const dockerScriptPrelude = `if command -v docker >/dev/null 2>&1; then
+    DOCKER=docker
+elif command -v podman >/dev/null 2>&1; then
+    DOCKER=podman
+else
+    gocd_fail RUN_CMD_FAILED "docker or podman not found"
+fi
+if [[ $(id -u) -ne 0 ]] && ! ${DOCKER} info >/dev/null 2>&1; then
+    DOCKER="sudo -n ${DOCKER}"
+fi`
+
+const dockerRunStage = `    ENV_ARGS=""
+    for KV in ${ENV_VAR}; do
+        ENV_ARGS="${ENV_ARGS} -e ${KV}"
+    done
+
+    ${DOCKER} rm -f ${CONTAINER_NAME} >/dev/null 2>&1
+    ${DOCKER} run -d --name ${CONTAINER_NAME} --restart unless-stopped ${ENV_ARGS} ${DOCKER_ARGS} ${IMAGE} ${RUN_CMD}`
+
+const dockerHealthCheckStage = `    sleep 3
+    if [[ "$(${DOCKER} inspect -f '{{.State.Running}}' ${CONTAINER_NAME})" != "true" ]]; then
+        ${DOCKER} logs --tail 50 ${CONTAINER_NAME}
+        gocd_fail HEALTH_CHECK "${CONTAINER_NAME} not running"
+    fi`
@@ -0,0 +1,158 @@
+package gocd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//脚本参数类型，对应jenkins参数定义
+const (
+	PARAM_TYPE_STRING   = "string" // 默认
+	PARAM_TYPE_BOOL     = "bool"
+	PARAM_TYPE_CHOICE   = "choice"
+	PARAM_TYPE_PASSWORD = "password"
+	PARAM_TYPE_TEXT     = "text" // 多行文本
+)
+
+var paramDefinitionClasses = map[string]string{
+	PARAM_TYPE_STRING:   "hudson.model.StringParameterDefinition",
+	PARAM_TYPE_BOOL:     "hudson.model.BooleanParameterDefinition",
+	PARAM_TYPE_CHOICE:   "hudson.model.ChoiceParameterDefinition",
+	PARAM_TYPE_PASSWORD: "hudson.model.PasswordParameterDefinition",
+	PARAM_TYPE_TEXT:     "hudson.model.TextParameterDefinition",
+}
+
+func (d *CdScriptParamDef) getType() string {
+	if d.Type == "" {
+		return PARAM_TYPE_STRING
+	}
+	return d.Type
+}
+
+//模板函数，按参数类型生成jenkins参数定义xml: {{range .ParameterDefs}}{{paramXml .}}{{end}}
+func renderParamDefXml(paramDef *CdScriptParamDef) (string, error) {
+	class, ok := paramDefinitionClasses[paramDef.getType()]
+	if !ok {
+		return "", fmt.Errorf("unsupported param type: %v %v", paramDef.Name, paramDef.Type)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\n        <" + class + ">")
+	sb.WriteString("\n          <name>" + escapeXmlText(paramDef.Name) + "</name>")
+	sb.WriteString("\n          <description>" + escapeXmlText(paramDef.Description) + "</description>")
+	switch paramDef.getType() {
+	case PARAM_TYPE_CHOICE:
+		//jenkins使用第一个选项作为默认值
+		sb.WriteString("\n          <choices class=\"java.util.Arrays$ArrayList\">\n            <a class=\"string-array\">")
+		for _, choice := range paramDef.getChoices() {
+			sb.WriteString("\n              <string>" + escapeXmlText(choice) + "</string>")
+		}
+		sb.WriteString("\n            </a>\n          </choices>")
+	case PARAM_TYPE_BOOL:
+		sb.WriteString("\n          <defaultValue>" + fmt.Sprint(paramDef.DefaultValue == "true") + "</defaultValue>")
+	case PARAM_TYPE_PASSWORD:
+		sb.WriteString("\n          <defaultValue>" + escapeXmlText(paramDef.DefaultValue) + "</defaultValue>")
+	default:
+		sb.WriteString("\n          <defaultValue>" + escapeXmlText(paramDef.DefaultValue) + "</defaultValue>")
+		sb.WriteString("\n          <trim>" + fmt.Sprint(paramDef.getType() == PARAM_TYPE_STRING) + "</trim>")
+	}
+	sb.WriteString("\n        </" + class + ">")
+	return sb.String(), nil
+}
+
+//默认值排在第一个
+func (d *CdScriptParamDef) getChoices() []string {
+	choices := make([]string, 0, len(d.Choices))
+	if d.DefaultValue != "" {
+		choices = append(choices, d.DefaultValue)
+	}
+	for _, choice := range d.Choices {
+		if choice != d.DefaultValue {
+			choices = append(choices, choice)
+		}
+	}
+	return choices
+}
+
+var xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
+//保留换行，job配置中的脚本在jenkins页面上可读
+func escapeXmlText(value string) string {
+	return xmlTextEscaper.Replace(value)
+}
+
+func compileParamPatterns(scriptParamDefs []*CdScriptParamDef) (map[string]*regexp.Regexp, error) {
+	patterns := make(map[string]*regexp.Regexp)
+	for _, paramDef := range scriptParamDefs {
+		if _, ok := paramDefinitionClasses[paramDef.getType()]; !ok {
+			return nil, fmt.Errorf("unsupported param type: %v %v", paramDef.Name, paramDef.Type)
+		}
+		if paramDef.Pattern == "" {
+			continue
+		}
+
+		reg, err := regexp.Compile("^(?:" + paramDef.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid param pattern: %v, err: %v", paramDef.Name, err)
+		}
+		patterns[paramDef.Name] = reg
+	}
+	return patterns, nil
+}
+
+//检查部署参数，未定义、缺少必填、类型或格式不符时返回ErrInvalidParam
+func (t *CdScript) ValidateParams(params map[string]string) error {
+	paramDefs := make(map[string]*CdScriptParamDef)
+	for _, paramDef := range t.scriptParamDefs {
+		paramDefs[paramDef.Name] = paramDef
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := paramDefs[name]; !ok {
+			return fmt.Errorf("%w: unknown param %v", ErrInvalidParam, name)
+		}
+	}
+
+	for _, paramDef := range t.scriptParamDefs {
+		value, ok := params[paramDef.Name]
+		if !ok {
+			//jenkins使用默认值
+			value = paramDef.DefaultValue
+			if paramDef.getType() == PARAM_TYPE_CHOICE {
+				if choices := paramDef.getChoices(); len(choices) > 0 {
+					value = choices[0]
+				}
+			}
+		}
+
+		if value == "" {
+			if paramDef.Required {
+				return fmt.Errorf("%w: missing required param %v", ErrInvalidParam, paramDef.Name)
+			}
+			continue
+		}
+
+		switch paramDef.getType() {
+		case PARAM_TYPE_BOOL:
+			if value != "true" && value != "false" {
+				return fmt.Errorf("%w: param %v is not bool: %v", ErrInvalidParam, paramDef.Name, value)
+			}
+		case PARAM_TYPE_CHOICE:
+			if !containsString(paramDef.getChoices(), value) {
+				return fmt.Errorf("%w: param %v not in choices: %v", ErrInvalidParam, paramDef.Name, value)
+			}
+		}
+
+		if reg, ok := t.paramPatterns[paramDef.Name]; ok && !reg.MatchString(value) {
+			return fmt.Errorf("%w: param %v not match %v", ErrInvalidParam, paramDef.Name, paramDef.Pattern)
+		}
+	}
+	return nil
+}
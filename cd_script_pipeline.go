@@ -0,0 +1,179 @@
+package gocd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/liumingmin/gojenkins"
+	"github.com/liumingmin/goutils/log"
+)
+
+//pipeline job选项，需要jenkins安装pipeline插件，Lock需要lockable-resources插件
+type CdPipelineOption struct {
+	Lock string // 资源名，使用同一资源的构建串行执行，为空时不加锁
+}
+
+//groovy脚本中的节点名占位，生成job配置时替换为节点名
+const pipelineNodePlaceholder = "__GOCD_NODE__"
+
+const pipelineJobClass = "org.jenkinsci.plugins.workflow.job.WorkflowJob"
+
+//pipeline options中的构建超时占位，生成job配置时替换为timeout选项或删除
+const pipelineTimeoutPlaceholder = "        __GOCD_TIMEOUT__\n"
+
+//非deploy操作在此阶段中执行完整脚本
+const pipelineActionStage = "action"
+
+const PipelineXmlTpl = `<?xml version='1.1' encoding='UTF-8'?>
+<flow-definition plugin="workflow-job">
+  <actions/>
+  <description>{{.Description}}</description>
+  <keepDependencies>false</keepDependencies>
+  <properties>
+    <org.jenkinsci.plugins.workflow.job.properties.DisableConcurrentBuildsJobProperty/>` + jobLogRotatorXmlTpl + `
+    <hudson.model.ParametersDefinitionProperty>
+      <parameterDefinitions>{{range .ParameterDefs}}{{paramXml .}}{{end}}
+      </parameterDefinitions>
+    </hudson.model.ParametersDefinitionProperty>
+  </properties>
+  <definition class="org.jenkinsci.plugins.workflow.cps.CpsFlowDefinition" plugin="workflow-cps">
+    <script>{{xml .PipelineScript}}</script>
+    <sandbox>true</sandbox>
+  </definition>
+  <triggers/>
+  <disabled>false</disabled>
+</flow-definition>`
+
+//生成pipeline job，每个部署阶段为一个pipeline stage，阶段结果可在DeployResult.Stages中获取
+func (b *CdScriptBuilder) Pipeline(option *CdPipelineOption) *CdScriptBuilder {
+	if option == nil {
+		option = &CdPipelineOption{}
+	}
+	b.pipeline = option
+	b.xmlTpl = PipelineXmlTpl
+	return b
+}
+
+//生成声明式pipeline脚本，每个stage的sh包含公共函数、prelude和阶段函数，阶段间只通过文件传递状态
+func (b *CdScriptBuilder) RenderPipeline() string {
+	var sb strings.Builder
+	sb.WriteString("pipeline {\n")
+	sb.WriteString("    agent { label '" + pipelineNodePlaceholder + "' }\n")
+	sb.WriteString("    options {\n        disableConcurrentBuilds()\n")
+	if b.pipeline != nil && b.pipeline.Lock != "" {
+		sb.WriteString("        lock(resource: '" + escapeGroovyString(b.pipeline.Lock) + "')\n")
+	}
+	sb.WriteString(pipelineTimeoutPlaceholder + "    }\n")
+	sb.WriteString("    stages {\n")
+
+	sb.WriteString(renderPipelineStage(pipelineActionStage, "params.ACTION != '"+ACTION_DEPLOY+"'", b.Render(), 0, 0))
+	for _, stage := range b.stages {
+		if stage.Content == "" {
+			continue
+		}
+		sb.WriteString(renderPipelineStage(stage.Name, "params.ACTION == '"+ACTION_DEPLOY+"'", b.renderPipelineStageShell(stage), int64(stage.Timeout.Seconds()), stage.Retry))
+	}
+
+	sb.WriteString("    }\n}\n")
+	return sb.String()
+}
+
+//每个deploy阶段的sh内容，Validate时逐个做语法检查
+func (b *CdScriptBuilder) renderPipelineShells() []string {
+	shells := make([]string, 0, len(b.stages))
+	for _, stage := range b.stages {
+		if stage.Content == "" {
+			continue
+		}
+		shells = append(shells, b.renderPipelineStageShell(stage))
+	}
+	return shells
+}
+
+func (b *CdScriptBuilder) renderPipelineStageShell(stage *CdScriptStage) string {
+	var shell strings.Builder
+	shell.WriteString("#!/bin/bash -il\n" + taskScriptFuncs + "\n" + taskScriptRunStage)
+	shell.WriteString(renderStageFunc(stage))
+	if b.prelude != "" {
+		shell.WriteString("\n" + strings.TrimRight(b.prelude, "\n") + "\n")
+	}
+	shell.WriteString("\n" + renderRunStage(stage))
+	return shell.String()
+}
+
+//替换节点名和构建超时占位
+func renderPipelineScript(pipelineScript, hostIp string, jobOption *CdJobOption) string {
+	timeout := jobOption.pipelineTimeout()
+	if timeout != "" {
+		timeout = "        " + timeout + "\n"
+	}
+	return strings.NewReplacer(pipelineNodePlaceholder, escapeGroovyString(hostIp), pipelineTimeoutPlaceholder, timeout).Replace(pipelineScript)
+}
+
+func renderPipelineStage(name, when, shell string, timeoutSeconds int64, retry int) string {
+	step := "sh '''" + escapeGroovyString(shell) + "'''"
+	if retry > 0 {
+		step = fmt.Sprintf("retry(%v) {\n%v\n}", retry+1, step)
+	}
+	if timeoutSeconds > 0 {
+		step = fmt.Sprintf("timeout(time: %v, unit: 'SECONDS') {\n%v\n}", timeoutSeconds, step)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("        stage('" + name + "') {\n")
+	sb.WriteString("            when { expression { " + when + " } }\n")
+	sb.WriteString("            steps {\n")
+	sb.WriteString(step + "\n")
+	sb.WriteString("            }\n")
+	sb.WriteString("        }\n")
+	return sb.String()
+}
+
+//groovy单引号字符串中转义反斜杠和单引号
+func escapeGroovyString(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+type cdPipelineDescribe struct {
+	Stages []struct {
+		Name            string `json:"name"`
+		Status          string `json:"status"`
+		StartTimeMillis int64  `json:"startTimeMillis"`
+		DurationMillis  int64  `json:"durationMillis"`
+	} `json:"stages"`
+}
+
+func isPipelineBuild(build *gojenkins.Build) bool {
+	return build.Job != nil && build.Job.Raw != nil && build.Job.Raw.Class == pipelineJobClass
+}
+
+//从wfapi获取pipeline stage结果，跳过未执行的stage
+func getPipelineStages(ctx context.Context, build *gojenkins.Build) ([]*DeployStage, error) {
+	describe := &cdPipelineDescribe{}
+	resp, err := build.Jenkins.Requester.Get(ctx, build.Base+"/wfapi/describe", describe, nil)
+	if err != nil {
+		log.Error(ctx, "get pipeline stages failed: %v, err: %v", build.Base, err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get pipeline stages failed: %v, status: %v", build.Base, resp.StatusCode)
+	}
+
+	stages := make([]*DeployStage, 0, len(describe.Stages))
+	for _, pipelineStage := range describe.Stages {
+		if pipelineStage.Status == "NOT_EXECUTED" {
+			continue
+		}
+		stages = append(stages, &DeployStage{
+			Name:      pipelineStage.Name,
+			Status:    pipelineStage.Status,
+			StartedAt: msToTime(pipelineStage.StartTimeMillis),
+			Duration:  time.Duration(pipelineStage.DurationMillis) * time.Millisecond,
+			Finished:  pipelineStage.Status != "IN_PROGRESS" && pipelineStage.Status != "PAUSED_PENDING_INPUT",
+		})
+	}
+	return stages, nil
+}
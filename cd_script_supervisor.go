@@ -0,0 +1,116 @@
+package gocd
+
+//以supervisord program运行服务，进程不受jenkins构建结束影响
+func NewSupervisorCdScript() *CdScript {
+	return MustCdScript(NewSupervisorCdScriptBuilder().Build())
+}
+
+func NewSupervisorCdScriptBuilder() *CdScriptBuilder {
+	builder := NewCdScriptBuilder([]*CdScriptParamDef{
+		{Name: "PKG_URL", Description: "程序包s3 key", Required: true},
+		{Name: "TARGET_PATH", Description: "程序目录", Required: true},
+		{Name: "RUN_CMD", Description: "运行脚本，相对TARGET_PATH", Required: true},
+		{Name: "ENV_VAR", Description: "环境变量"},
+		{Name: "PROGRAM_NAME", Description: "supervisor program名称", Required: true, Pattern: `[A-Za-z0-9_.-]+`},
+		{Name: "RUN_USER", Description: "运行用户，为空时为supervisord运行用户", Pattern: `[a-z_][a-z0-9_-]*`},
+	})
+	builder.AddParamDef(newPackageParamDefs()...)
+	builder.Version(supervisorTaskScriptVer).Prelude(taskScriptPackagePrelude)
+	builder.AddStage(newPackageStages()...)
+	builder.InsertStageAfter(STAGE_SYNC, &CdScriptStage{Name: STAGE_INSTALL, Content: supervisorInstallStage})
+	builder.AddStage(&CdScriptStage{Name: STAGE_RUN, Content: `    ${SUDO} supervisorctl restart ${PROGRAM_NAME}`})
+	builder.AddStage(&CdScriptStage{Name: STAGE_HEALTH_CHECK, FailCode: FAIL_CODE_HEALTH_CHECK, Content: supervisorHealthCheckStage})
+
+	builder.Action("start|stop|restart", `gocd_stage ${ACTION}
+${SUDO} supervisorctl ${ACTION} ${PROGRAM_NAME}
+if [[ $? -ne 0 ]]; then
+    gocd_fail RUN_CMD_FAILED "supervisorctl ${ACTION} ${PROGRAM_NAME}"
+fi`)
+	builder.Action(ACTION_STATUS, `STATE=$(${SUDO} supervisorctl status ${PROGRAM_NAME})
+if echo "${STATE}" | grep -q RUNNING; then
+    gocd_status running "${STATE}"
+else
+    gocd_status stopped "${STATE}"
+fi`)
+	builder.Action(ACTION_ROLLBACK, `gocd_stage rollback
+gocd_rollback
+gocd_run_stage pre_start HOOK_FAILED
+gocd_run_stage run RUN_CMD_FAILED
+gocd_run_stage health_check HEALTH_CHECK`)
+	builder.Action(ACTION_UNINSTALL, `gocd_stage uninstall
+${SUDO} supervisorctl stop ${PROGRAM_NAME}
+${SUDO} rm -f /etc/supervisor/conf.d/${PROGRAM_NAME}.conf /etc/supervisord.d/${PROGRAM_NAME}.ini
+${SUDO} supervisorctl reread
+${SUDO} supervisorctl update
+gocd_remove_target`)
+	return builder
+}
+
+//runUser为空时使用supervisord的运行用户
+func NewSupervisorCdService(name, pkgUrl, targetPath, runCmd, runUser string, envVar map[string]string) CdService {
+	return &DefaultCdService{
+		name: name,
+		params: map[string]string{
+			"PKG_URL":      pkgUrl,
+			"TARGET_PATH":  targetPath,
+			"RUN_CMD":      runCmd,
+			"ENV_VAR":      formatEnvVar(envVar),
+			"PROGRAM_NAME": name,
+			"RUN_USER":     runUser,
+		},
+		cdScript: NewSupervisorCdScript(),
+	}
+}
+
+const supervisorTaskScriptVer = 1
+
+//生成program配置，debian系为conf.d/*.conf，redhat系为supervisord.d/*.ini
+const supervisorInstallStage = `    if [[ -d /etc/supervisor/conf.d ]]; then
+        PROGRAM_FILE=/etc/supervisor/conf.d/${PROGRAM_NAME}.conf
+    elif [[ -d /etc/supervisord.d ]]; then
+        PROGRAM_FILE=/etc/supervisord.d/${PROGRAM_NAME}.ini
+    else
+        gocd_fail RUN_CMD_FAILED "supervisor config dir not found"
+    fi
+
+    ENVIRONMENT=""
+    for KV in ${ENV_VAR}; do
+        ENVIRONMENT="${ENVIRONMENT:+${ENVIRONMENT},}${KV%%=*}=\"${KV#*=}\""
+    done
+
+    mkdir -p ${TARGET_PATH}/logs
+    TMP_PROGRAM_FILE=$(mktemp)
+    {
+        echo "[program:${PROGRAM_NAME}]"
+        echo "command=/bin/bash ${RUN_CMD}"
+        echo "directory=${CURRENT_LINK}"
+        if [[ -n "${ENVIRONMENT}" ]]; then
+            echo "environment=${ENVIRONMENT}"
+        fi
+        if [[ -n "${RUN_USER}" ]]; then
+            echo "user=${RUN_USER}"
+        fi
+        echo "autostart=true"
+        echo "autorestart=true"
+        echo "stopasgroup=true"
+        echo "killasgroup=true"
+        echo "redirect_stderr=true"
+        echo "stdout_logfile=${TARGET_PATH}/logs/${PROGRAM_NAME}.log"
+    } > ${TMP_PROGRAM_FILE}
+    ${SUDO} install -m 644 ${TMP_PROGRAM_FILE} ${PROGRAM_FILE} && rm -f ${TMP_PROGRAM_FILE}
+    if [[ $? -ne 0 ]]; then
+        gocd_fail RUN_CMD_FAILED "install ${PROGRAM_FILE}"
+    fi
+    if [[ -n "${RUN_USER}" ]]; then
+        ${SUDO} chown -R ${RUN_USER} ${TARGET_PATH}
+    fi
+
+    ${SUDO} supervisorctl reread
+    ${SUDO} supervisorctl update ${PROGRAM_NAME}`
+
+const supervisorHealthCheckStage = `    sleep 3
+    ${SUDO} supervisorctl status ${PROGRAM_NAME} | grep -q RUNNING
+    if [[ $? -ne 0 ]]; then
+        tail -n 50 ${TARGET_PATH}/logs/${PROGRAM_NAME}.log
+        gocd_fail HEALTH_CHECK "${PROGRAM_NAME} not running"
+    fi`
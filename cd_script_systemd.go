@@ -0,0 +1,106 @@
+package gocd
+
+//以systemd unit运行服务，进程不受jenkins构建结束影响
+func NewSystemdCdScript() *CdScript {
+	return MustCdScript(NewSystemdCdScriptBuilder().Build())
+}
+
+func NewSystemdCdScriptBuilder() *CdScriptBuilder {
+	builder := NewCdScriptBuilder([]*CdScriptParamDef{
+		{Name: "PKG_URL", Description: "程序包s3 key", Required: true},
+		{Name: "TARGET_PATH", Description: "程序目录", Required: true},
+		{Name: "RUN_CMD", Description: "运行脚本，相对TARGET_PATH", Required: true},
+		{Name: "ENV_VAR", Description: "环境变量"},
+		{Name: "UNIT_NAME", Description: "systemd unit名称", Required: true, Pattern: `[A-Za-z0-9_.@-]+`},
+		{Name: "RUN_USER", Description: "运行用户，为空时为root", Pattern: `[a-z_][a-z0-9_-]*`},
+	})
+	builder.AddParamDef(newPackageParamDefs()...)
+	builder.Version(systemdTaskScriptVer).Prelude(taskScriptPackagePrelude)
+	builder.AddStage(newPackageStages()...)
+	builder.InsertStageAfter(STAGE_SYNC, &CdScriptStage{Name: STAGE_INSTALL, Content: systemdInstallStage})
+	builder.AddStage(&CdScriptStage{Name: STAGE_RUN, Content: `    ${SUDO} systemctl restart ${UNIT_NAME}`})
+	builder.AddStage(&CdScriptStage{Name: STAGE_HEALTH_CHECK, FailCode: FAIL_CODE_HEALTH_CHECK, Content: systemdHealthCheckStage})
+
+	builder.Action("start|stop|restart", `gocd_stage ${ACTION}
+${SUDO} systemctl ${ACTION} ${UNIT_NAME}
+if [[ $? -ne 0 ]]; then
+    gocd_fail RUN_CMD_FAILED "systemctl ${ACTION} ${UNIT_NAME}"
+fi`)
+	builder.Action(ACTION_STATUS, `STATE=$(systemctl is-active ${UNIT_NAME})
+if [[ "${STATE}" == "active" ]]; then
+    gocd_status running "$(systemctl show -p MainPID -p ActiveEnterTimestamp ${UNIT_NAME} | tr '\n' ' ')"
+else
+    gocd_status stopped "${STATE}"
+fi`)
+	builder.Action(ACTION_ROLLBACK, `gocd_stage rollback
+gocd_rollback
+gocd_run_stage pre_start HOOK_FAILED
+gocd_run_stage run RUN_CMD_FAILED
+gocd_run_stage health_check HEALTH_CHECK`)
+	builder.Action(ACTION_UNINSTALL, `gocd_stage uninstall
+${SUDO} systemctl disable --now ${UNIT_NAME}
+${SUDO} rm -f /etc/systemd/system/${UNIT_NAME}.service
+${SUDO} systemctl daemon-reload
+gocd_remove_target`)
+	return builder
+}
+
+//runUser为空时使用root运行
+func NewSystemdCdService(name, pkgUrl, targetPath, runCmd, runUser string, envVar map[string]string) CdService {
+	return &DefaultCdService{
+		name: name,
+		params: map[string]string{
+			"PKG_URL":     pkgUrl,
+			"TARGET_PATH": targetPath,
+			"RUN_CMD":     runCmd,
+			"ENV_VAR":     formatEnvVar(envVar),
+			"UNIT_NAME":   name,
+			"RUN_USER":    runUser,
+		},
+		cdScript: NewSystemdCdScript(),
+	}
+}
+
+const systemdTaskScriptVer = 1
+
+//生成unit文件
+const systemdInstallStage = `    UNIT_FILE=/etc/systemd/system/${UNIT_NAME}.service
+    TMP_UNIT_FILE=$(mktemp)
+    {
+        echo "[Unit]"
+        echo "Description=${UNIT_NAME} deployed by gocd"
+        echo "After=network.target"
+        echo ""
+        echo "[Service]"
+        echo "Type=simple"
+        echo "WorkingDirectory=${CURRENT_LINK}"
+        echo "ExecStart=/bin/bash ${RUN_CMD}"
+        if [[ -n "${RUN_USER}" ]]; then
+            echo "User=${RUN_USER}"
+        fi
+        for KV in ${ENV_VAR}; do
+            echo "Environment=\"${KV}\""
+        done
+        echo "Restart=always"
+        echo "RestartSec=3"
+        echo ""
+        echo "[Install]"
+        echo "WantedBy=multi-user.target"
+    } > ${TMP_UNIT_FILE}
+    ${SUDO} install -m 644 ${TMP_UNIT_FILE} ${UNIT_FILE} && rm -f ${TMP_UNIT_FILE}
+    if [[ $? -ne 0 ]]; then
+        gocd_fail RUN_CMD_FAILED "install ${UNIT_FILE}"
+    fi
+    if [[ -n "${RUN_USER}" ]]; then
+        ${SUDO} chown -R ${RUN_USER} ${TARGET_PATH}
+    fi
+
+    ${SUDO} systemctl daemon-reload
+    ${SUDO} systemctl enable ${UNIT_NAME}`
+
+const systemdHealthCheckStage = `    sleep 3
+    ${SUDO} systemctl is-active --quiet ${UNIT_NAME}
+    if [[ $? -ne 0 ]]; then
+        ${SUDO} journalctl -u ${UNIT_NAME} -n 50 --no-pager
+        gocd_fail HEALTH_CHECK "${UNIT_NAME} not active"
+    fi`
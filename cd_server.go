@@ -2,9 +2,9 @@ package gocd
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/liumingmin/gojenkins"
@@ -12,23 +12,85 @@ import (
 )
 
 const (
-	RUN_STATUS_RUNNING = 1
-	RUN_STATUS_FINISH  = 2
-	RUN_STATUS_ERR     = 3
+	RUN_STATUS_RUNNING   = 1
+	RUN_STATUS_FINISH    = 2
+	RUN_STATUS_ERR       = 3
+	RUN_STATUS_CANCELLED = 4 // 通过CancelDeploy取消
+	RUN_STATUS_QUEUED    = 5
+	RUN_STATUS_UNSTABLE  = 6
+	RUN_STATUS_ABORTED   = 7 // 被jenkins中止，如构建超时或在jenkins中手动停止
+
+	RUN_STATUS_SUCCESS = RUN_STATUS_FINISH
+	RUN_STATUS_FAILED  = RUN_STATUS_ERR
+)
+
+//CancelDeploy停止构建前在构建描述中添加的标记，用于区分取消和jenkins中止
+const deployCancelledMarker = "gocd:cancelled"
+
+const (
+	defaultSlotWaitTimeout  = time.Minute
+	defaultSlotWaitInterval = 2 * time.Second
 )
 
 type CdServer struct {
-	jenkins *gojenkins.Jenkins
-	env     string
-	s3Info  *CdS3Info
+	jenkins   *gojenkins.Jenkins
+	env       string
+	s3Info    *CdS3Info
+	jobFolder string // job根目录，job路径: jobFolder/env/service/jobName，为空时job放在jenkins根目录
+	jobOption *CdJobOption
+
+	slotWaitTimeout  time.Duration // 节点所有执行器繁忙时的最长等待时间
+	slotWaitInterval time.Duration
 
-	nodeBroker *CdNodeBroker
+	deployLock     DeployLock // 同一服务同一节点的部署锁
+	deployLockMode int
+
+	nodeBroker     *CdNodeBroker
+	createdFolder  sync.Map
+	resolvedBuilds cdBuildCache // jobName#taskId -> *cdResolvedBuild
+	stoppingNodes  sync.Map     // 临时上线执行停止的下线节点，期间拒绝其他操作
+}
+
+type DeployTask struct {
+	NodeName   string
+	JobName    string
+	TaskId     int64
+	Err        error
+	Deployment *Deployment // 部署失败时为nil
 }
 
 type DeployResult struct {
 	Status        int
 	Result        string
 	ConsoleOutput string
+
+	BuildNumber int64
+	DeployId    string // GOCD_DEPLOY_ID参数
+	NodeName    string // 实际运行构建的节点
+	QueuedAt    time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time     // 未结束时为空
+	QueueWait   time.Duration // 排队等待时间
+	Duration    time.Duration
+	ExitCode    int // 脚本退出码，脚本未输出gocd:exit时为-1
+	Stages      []*DeployStage
+	FailCode    string // 脚本输出的失败码 FAIL_CODE_*
+	FailDetail  string
+
+	ServiceStatus *CdServiceStatus // status操作的结果
+}
+
+//部署失败时返回错误分类，排队、运行中和成功(包括UNSTABLE)返回nil
+func (r *DeployResult) Err() error {
+	switch r.Status {
+	case RUN_STATUS_QUEUED, RUN_STATUS_RUNNING, RUN_STATUS_SUCCESS, RUN_STATUS_UNSTABLE:
+		return nil
+	case RUN_STATUS_CANCELLED:
+		return ErrDeployCancelled
+	case RUN_STATUS_ABORTED:
+		return ErrDeployAborted
+	}
+	return &DeployError{Code: r.FailCode, Detail: r.FailDetail, ExitCode: r.ExitCode, Err: getFailCodeError(r.FailCode)}
 }
 
 func NewCdServer(ctx context.Context, url, username, token, env string, options ...CdServerOption) *CdServer {
@@ -41,6 +103,12 @@ func NewCdServer(ctx context.Context, url, username, token, env string, options
 		jenkins:    jenkins,
 		env:        env,
 		nodeBroker: NewCdNodeBroker(jenkins, env, nil),
+
+		slotWaitTimeout:  defaultSlotWaitTimeout,
+		slotWaitInterval: defaultSlotWaitInterval,
+
+		deployLock:     NewMemDeployLock(),
+		deployLockMode: DEPLOY_LOCK_NONE,
 	}
 
 	if len(options) > 0 {
@@ -56,111 +124,441 @@ func (j *CdServer) GetNodeBroker() *CdNodeBroker {
 	return j.nodeBroker
 }
 
-func (j *CdServer) getOrCreateJob(ctx context.Context, service CdService, node *gojenkins.Node) (string, *gojenkins.Job, error) {
-	idx := int64(service.IncDeployCounter()) % node.Raw.NumExecutors
-	jobName := fmt.Sprintf("%v-%v-%v-%v-%v", service.GetCdScript().scriptVersion, j.env, service.GetName(), node.GetName(), idx)
+//依次检查节点上每个执行器对应的job，选择空闲的job；全部繁忙时等待，不依赖进程内计数，多个gocd进程可同时使用
+func (j *CdServer) acquireJobSlot(ctx context.Context, service CdService, node *CdNode) (string, *gojenkins.Job, error) {
+	taskConfig, configHash, err := service.GetCdScript().getCdTaskScriptConfigWithHash(node.GetName(), j.env, j.jobOption)
+	if err != nil {
+		return "", nil, err
+	}
 
-	job, err := j.jenkins.GetJob(ctx, jobName)
-	if err != nil || job == nil {
-		taskConfig, err := service.GetCdScript().GetCdTaskScriptConfig(node.GetName())
-		//fmt.Println(taskConfig)
-		if err != nil {
-			return jobName, nil, err
+	return j.waitJobSlot(ctx, node, func(idx int64) (string, *gojenkins.Job, error) {
+		return j.getOrCreateJob(ctx, service, node, idx, taskConfig, configHash)
+	})
+}
+
+//getJob返回执行器idx对应的job，全部繁忙时每slotWaitInterval检查一次，超过slotWaitTimeout返回ErrQueueTimeout
+func (j *CdServer) waitJobSlot(ctx context.Context, node *CdNode, getJob func(idx int64) (string, *gojenkins.Job, error)) (string, *gojenkins.Job, error) {
+	deadline := time.Now().Add(j.slotWaitTimeout)
+	for {
+		for idx := int64(0); idx < node.Raw.NumExecutors; idx++ {
+			jobFullName, job, err := getJob(idx)
+			if err != nil {
+				return jobFullName, nil, err
+			}
+			if job != nil && !isJobBusy(job) {
+				return jobFullName, job, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return "", nil, fmt.Errorf("%w: no idle job slot on node: %v", ErrQueueTimeout, node.GetName())
 		}
 
-		_, err = j.jenkins.CreateJob(ctx, taskConfig, jobName)
+		log.Debug(ctx, "all job slots busy, node: %v", node.GetName())
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(j.slotWaitInterval):
+		}
+	}
+}
+
+func (j *CdServer) getOrCreateJob(ctx context.Context, service CdService, node *CdNode, idx int64, taskConfig, configHash string) (string, *gojenkins.Job, error) {
+	jobName := formatJobName(service.GetCdScript().scriptVersion, j.env, service.GetName(), node.GetName(), idx)
+	parents := j.getJobParents(service.GetName())
+	jobFullName := formatJobFullName(jobName, parents)
+
+	job, err := j.jenkins.GetJob(ctx, jobName, parents...)
+	if err == nil && job != nil {
+		if !strings.Contains(job.GetDescription(), formatJobDescription(j.env, configHash)) {
+			err = job.UpdateConfig(ctx, taskConfig)
+			if err != nil {
+				log.Error(ctx, "UpdateConfig failed: %v, err: %v", jobFullName, err)
+				return jobFullName, nil, fmt.Errorf("%w: %v, err: %v", ErrJobCreate, jobFullName, err)
+			}
+			log.Info(ctx, "UpdateConfig ok: %v, hash: %v", jobFullName, configHash)
+		}
+	} else {
+		if err = j.ensureJobFolders(ctx, parents); err != nil {
+			log.Error(ctx, "CreateFolder failed: %v, err: %v", parents, err)
+			return jobFullName, nil, fmt.Errorf("%w: %v, err: %v", ErrJobCreate, jobFullName, err)
+		}
+
+		if len(parents) > 0 {
+			_, err = j.jenkins.CreateJobInFolder(ctx, taskConfig, jobName, parents...)
+		} else {
+			_, err = j.jenkins.CreateJob(ctx, taskConfig, jobName)
+		}
 		if err != nil {
-			log.Error(ctx, "CreateJob failed: %v, err: %v", jobName, err)
-			return jobName, nil, err
+			log.Error(ctx, "CreateJob failed: %v, err: %v", jobFullName, err)
+			return jobFullName, nil, fmt.Errorf("%w: %v, err: %v", ErrJobCreate, jobFullName, err)
 		}
 
 		for i := 0; i < 3; i++ {
-			job, err = j.jenkins.GetJob(ctx, jobName)
+			job, err = j.jenkins.GetJob(ctx, jobName, parents...)
 			if err != nil || job == nil {
-				log.Debug(ctx, "GetJob failed: %v, err: %v", jobName, err)
+				log.Debug(ctx, "GetJob failed: %v, err: %v", jobFullName, err)
 				time.Sleep(time.Second)
 				continue
 			}
 
-			log.Info(ctx, "GetJob ok: %v", jobName)
+			log.Info(ctx, "GetJob ok: %v", jobFullName)
 			break
 		}
 	}
-	return jobName, job, nil
+	return jobFullName, job, nil
 }
 
 func (j *CdServer) DeploySimple(ctx context.Context, service CdService, nodeName string) (string, int64, error) {
+	return j.DeploySimpleWithId(ctx, service, nodeName, NewDeployId())
+}
+
+//deployId由调用方通过NewDeployId生成，队列项过期后可用GetDeployResultByDeployId查询
+func (j *CdServer) DeploySimpleWithId(ctx context.Context, service CdService, nodeName, deployId string) (string, int64, error) {
+	if deployId == "" {
+		return "", 0, fmt.Errorf("%w: empty deployId", ErrInvalidParam)
+	}
+
 	node := j.nodeBroker.GetNodeByName(nodeName)
 	if node == nil {
-		return "", 0, errors.New("not found node")
+		return "", 0, fmt.Errorf("%w: %v", ErrNodeNotFound, nodeName)
+	}
+
+	return j.deploy(ctx, service, node, deployId, ACTION_DEPLOY, nil)
+}
+
+//按节点标签选择器部署到多个节点，单个节点失败记录在DeployTask.Err中
+//选择器不能为空，防止部署到本环境所有节点
+func (j *CdServer) DeployBySelector(ctx context.Context, service CdService, selector string) ([]*DeployTask, error) {
+	if strings.TrimSpace(selector) == "" {
+		return nil, fmt.Errorf("%w: empty selector", ErrInvalidParam)
+	}
+
+	nodes, err := j.nodeBroker.SelectNodes(selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%w: %v", ErrNodeNotFound, selector)
 	}
 
-	return j.deploy(ctx, service, node)
+	tasks := make([]*DeployTask, 0, len(nodes))
+	for _, node := range nodes {
+		deployId := NewDeployId()
+		jobName, taskId, err := j.deploy(ctx, service, node, deployId, ACTION_DEPLOY, nil)
+		if err != nil {
+			log.Error(ctx, "deploy to node failed: %v, err: %v", node.GetName(), err)
+		}
+		task := &DeployTask{NodeName: node.GetName(), JobName: jobName, TaskId: taskId, Err: err}
+		if err == nil {
+			task.Deployment = &Deployment{server: j, jobName: jobName, taskId: taskId, deployId: deployId, nodeName: node.GetName()}
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
 }
 
-func (j *CdServer) deploy(ctx context.Context, service CdService, node *gojenkins.Node) (string, int64, error) {
-	jobName, job, err := j.getOrCreateJob(ctx, service, node)
+func (j *CdServer) deploy(ctx context.Context, service CdService, node *CdNode, deployId, action string, actionParams map[string]string) (string, int64, error) {
+	ctx = withDeployIdCtx(ctx, deployId)
+	log.Info(ctx, "deploy service: %v, node: %v, deployId: %v, action: %v", service.GetName(), node.GetName(), deployId, action)
+
+	if err := j.nodeBroker.checkNodeEnabled(ctx, node); err != nil {
+		log.Error(ctx, "deploy refused: %v", err)
+		return "", 0, err
+	}
+	if _, ok := j.stoppingNodes.Load(node.GetName()); ok && action != ACTION_STOP {
+		log.Error(ctx, "deploy refused: node stopping: %v", node.GetName())
+		return "", 0, fmt.Errorf("%w: %v stopping", ErrNodeDisabled, node.GetName())
+	}
+
+	params, err := j.getDeployParams(service, deployId, action, actionParams)
 	if err != nil {
-		return jobName, 0, err
+		log.Error(ctx, "deploy refused: %v", err)
+		return "", 0, err
 	}
 
-	//s3get env
-	var s3EnvsStr strings.Builder
-	for key, value := range j.s3Info.envVar() {
-		s3EnvsStr.WriteString(fmt.Sprintf(" %v=%v", key, value))
+	deadline := time.Now().Add(j.slotWaitTimeout)
+	for {
+		jobName, job, err := j.acquireJobSlot(ctx, service, node)
+		if err != nil {
+			return jobName, 0, err
+		}
+
+		lockOwner, err := j.lockDeploy(ctx, service, node, jobName, action)
+		if err != nil {
+			return jobName, 0, err
+		}
+
+		taskId, err := job.InvokeSimple(ctx, params)
+		if err != nil {
+			log.Error(ctx, "job build failed: %v", err)
+			j.unlockDeploy(ctx, service, node, lockOwner)
+			return jobName, 0, err
+		}
+
+		//job已在队列中(被其他进程抢占)时返回0，重新选择
+		if taskId != 0 {
+			service.IncDeployCounter()
+			return jobName, taskId, nil
+		}
+		j.unlockDeploy(ctx, service, node, lockOwner)
+
+		if time.Now().After(deadline) {
+			return jobName, 0, fmt.Errorf("%w: job slot taken: %v", ErrQueueTimeout, jobName)
+		}
+		log.Warn(ctx, "job slot taken, retry: %v", jobName)
+		select {
+		case <-ctx.Done():
+			return jobName, 0, ctx.Err()
+		case <-time.After(j.slotWaitInterval):
+		}
 	}
+}
 
+//未设置CdServerS3Option时不传s3get参数，只能使用不需要s3get的脚本(如docker)
+func (j *CdServer) getDeployParams(service CdService, deployId, action string, actionParams map[string]string) (map[string]string, error) {
 	params := map[string]string{
-		"RUN_ENV":   j.env,
-		"S3GET_URL": j.s3Info.s3GetToolUrl,
-		"S3ENV_VAR": s3EnvsStr.String(),
+		"RUN_ENV": j.env,
+
+		deployIdParamName: deployId,
 	}
 
-	// service generate svc params
+	//s3get env
+	if j.s3Info != nil {
+		var s3EnvsStr strings.Builder
+		for key, value := range j.s3Info.envVar() {
+			s3EnvsStr.WriteString(fmt.Sprintf(" %v=%v", key, value))
+		}
+		params["S3GET_URL"] = j.s3Info.s3GetToolUrl
+		params["S3ENV_VAR"] = s3EnvsStr.String()
+	}
+
+	//service generate svc params
 	svcParams := service.GetParams()
 	for k, v := range svcParams {
 		params[k] = v
 	}
+	for k, v := range actionParams {
+		params[k] = v
+	}
+	params[actionParamName] = action
+
+	if err := service.GetCdScript().ValidateParams(params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
 
-	taskId, err := job.InvokeSimple(ctx, params)
+//DryRun生成的部署内容，与实际部署时发送给jenkins的一致
+type DeployPlan struct {
+	JobName  string            // job全路径名，实际部署时使用第一个空闲执行器对应的job
+	Config   string            // job配置xml
+	Params   map[string]string // 构建参数，包含S3ENV_VAR等敏感信息
+	DeployId string
+	NodeName string
+}
+
+//检查脚本和参数，返回部署时使用的job名、配置和参数，不访问jenkins
+func (j *CdServer) DryRun(ctx context.Context, service CdService, nodeName string) (*DeployPlan, error) {
+	node := j.nodeBroker.GetNodeByName(nodeName)
+	if node == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNodeNotFound, nodeName)
+	}
+
+	cdScript := service.GetCdScript()
+	if err := cdScript.Validate(); err != nil {
+		log.Error(ctx, "validate script failed: %v, err: %v", service.GetName(), err)
+		return nil, err
+	}
+
+	config, _, err := cdScript.getCdTaskScriptConfigWithHash(node.GetName(), j.env, j.jobOption)
 	if err != nil {
-		log.Error(ctx, "job build failed: %v", err)
-		return jobName, 0, err
+		return nil, err
+	}
+
+	deployId := NewDeployId()
+	params, err := j.getDeployParams(service, deployId, ACTION_DEPLOY, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return jobName, taskId, nil
+	jobName := formatJobName(cdScript.scriptVersion, j.env, service.GetName(), node.GetName(), 0)
+	return &DeployPlan{
+		JobName:  formatJobFullName(jobName, j.getJobParents(service.GetName())),
+		Config:   config,
+		Params:   params,
+		DeployId: deployId,
+		NodeName: node.GetName(),
+	}, nil
 }
 
+//jobName为deploy返回的job全路径名，任务仍在队列中时返回RUN_STATUS_QUEUED
 func (j *CdServer) GetDeployResult(ctx context.Context, jobName string, taskId int64) (*DeployResult, error) {
-	job, err := j.jenkins.GetJob(ctx, jobName)
+	return j.getDeployResult(ctx, jobName, taskId, "")
+}
+
+//按GOCD_DEPLOY_ID在job最近构建中查找，不依赖队列id
+func (j *CdServer) GetDeployResultByDeployId(ctx context.Context, jobName, deployId string) (*DeployResult, error) {
+	ctx = withDeployIdCtx(ctx, deployId)
+	buildNumber, err := j.findBuildByDeployId(ctx, jobName, deployId)
+	if err != nil {
+		log.Error(ctx, "find build failed: %v, err: %v", jobName, err)
+		return nil, err
+	}
+
+	item := &cdQueueItem{}
+	item.Executable.Number = buildNumber
+	return j.getDeployResultFromItem(ctx, jobName, item)
+}
+
+func (j *CdServer) getDeployResult(ctx context.Context, jobName string, taskId int64, deployId string) (*DeployResult, error) {
+	item, err := j.resolveBuild(ctx, jobName, taskId, deployId)
+	if err != nil {
+		log.Error(ctx, "get queue item failed: %v, err: %v", taskId, err)
+		return nil, err
+	}
+	return j.getDeployResultFromItem(ctx, jobName, item)
+}
+
+func (j *CdServer) getDeployResultFromItem(ctx context.Context, jobName string, item *cdQueueItem) (*DeployResult, error) {
+	taskBuild := &DeployResult{ExitCode: -1, QueuedAt: msToTime(item.InQueueSince)}
+	if item.Cancelled {
+		taskBuild.Status = RUN_STATUS_CANCELLED
+		taskBuild.Result = "CANCELLED"
+		return taskBuild, nil
+	}
+	if item.Executable.Number == 0 {
+		taskBuild.Status = RUN_STATUS_QUEUED
+		taskBuild.Result = item.Why
+		if !taskBuild.QueuedAt.IsZero() {
+			taskBuild.QueueWait = time.Since(taskBuild.QueuedAt)
+		}
+		return taskBuild, nil
+	}
+
+	job, err := j.getJobByFullName(ctx, jobName)
 	if err != nil {
 		log.Error(ctx, "get job from jenkins failed: %v, err: %v", jobName, err)
 		return nil, err
 	}
 
-	build, err := j.jenkins.GetBuildFromQueueID(ctx, job, taskId)
-	if err != nil || build == nil {
-		log.Error(ctx, "get build from jenkins failed: %v, err: %v", taskId, err)
+	build, err := job.GetBuild(ctx, item.Executable.Number)
+	if err != nil {
+		log.Error(ctx, "get build from jenkins failed: %v, err: %v", item.Executable.Number, err)
 		return nil, err
 	}
 
+	setBuildDeployId(ctx, build)
+	fillDeployResult(ctx, taskBuild, build)
+	j.releaseFinishedDeployLock(ctx, jobName, taskBuild)
+
+	log.Info(ctx, "get build result from jenkins  %v", taskBuild)
+	return taskBuild, nil
+}
+
+//通过CancelDeploy停止的构建为RUN_STATUS_CANCELLED，其他中止的构建为RUN_STATUS_ABORTED
+func getFinishedBuildStatus(build *gojenkins.Build) int {
+	switch build.GetResult() {
+	case gojenkins.STATUS_SUCCESS:
+		return RUN_STATUS_SUCCESS
+	case gojenkins.STATUS_ABORTED:
+		if build.Raw.Description != nil && strings.Contains(fmt.Sprint(build.Raw.Description), deployCancelledMarker) {
+			return RUN_STATUS_CANCELLED
+		}
+		return RUN_STATUS_ABORTED
+	case "UNSTABLE":
+		return RUN_STATUS_UNSTABLE
+	}
+	return RUN_STATUS_FAILED
+}
+
+func fillDeployResult(ctx context.Context, taskBuild *DeployResult, build *gojenkins.Build) {
 	status := RUN_STATUS_RUNNING
 	if !build.IsRunning(ctx) {
-		if build.IsGood(ctx) {
-			status = RUN_STATUS_FINISH
-		} else {
-			status = RUN_STATUS_ERR
+		status = getFinishedBuildStatus(build)
+	}
+
+	taskBuild.Status = status
+	taskBuild.Result = build.GetResult()
+	taskBuild.ConsoleOutput = build.GetConsoleOutput(ctx)
+	taskBuild.BuildNumber = build.GetBuildNumber()
+	taskBuild.DeployId = getBuildDeployId(build)
+	//pipeline构建的builtOn为空，节点由agent决定
+	taskBuild.NodeName = build.Raw.BuiltOn
+	if taskBuild.NodeName == "" && !isPipelineBuild(build) {
+		taskBuild.NodeName = "master"
+	}
+
+	taskBuild.StartedAt = build.GetTimestamp()
+	if !taskBuild.QueuedAt.IsZero() {
+		taskBuild.QueueWait = taskBuild.StartedAt.Sub(taskBuild.QueuedAt)
+	}
+	if status == RUN_STATUS_RUNNING {
+		taskBuild.Duration = time.Since(taskBuild.StartedAt)
+	} else {
+		taskBuild.Duration = time.Duration(build.GetDuration()) * time.Millisecond
+		taskBuild.FinishedAt = taskBuild.StartedAt.Add(taskBuild.Duration)
+	}
+
+	markers := parseDeployMarkers(taskBuild.ConsoleOutput)
+	taskBuild.Stages = markers.stages
+	taskBuild.ExitCode = markers.exitCode
+	taskBuild.FailCode = markers.failCode
+	taskBuild.FailDetail = markers.failDetail
+	taskBuild.ServiceStatus = markers.status
+	if taskBuild.ServiceStatus != nil {
+		taskBuild.ServiceStatus.NodeName = taskBuild.NodeName
+	}
+
+	if isPipelineBuild(build) {
+		if stages, err := getPipelineStages(ctx, build); err == nil {
+			taskBuild.Stages = stages
 		}
 	}
+}
 
-	taskBuild := &DeployResult{
-		Status:        status,
-		Result:        build.GetResult(),
-		ConsoleOutput: build.GetConsoleOutput(ctx),
+//取消部署，仍在队列中时从队列移除，已开始运行时停止构建
+func (j *CdServer) CancelDeploy(ctx context.Context, jobName string, taskId int64) error {
+	item, err := j.resolveBuild(ctx, jobName, taskId, "")
+	if err != nil {
+		log.Error(ctx, "get queue item failed: %v, err: %v", taskId, err)
+		return err
+	}
+	if item.Cancelled {
+		return nil
 	}
 
-	log.Info(ctx, "get build result from jenkins  %v", taskBuild)
-	return taskBuild, nil
+	if item.Executable.Number == 0 {
+		if err = j.cancelQueueItem(ctx, taskId); err != nil {
+			return err
+		}
+
+		//取消前可能已开始运行
+		item, err = j.getQueueItemWithRetry(ctx, taskId)
+		if err != nil || item.Executable.Number == 0 {
+			return err
+		}
+	}
+
+	job, err := j.getJobByFullName(ctx, jobName)
+	if err != nil {
+		log.Error(ctx, "get job from jenkins failed: %v, err: %v", jobName, err)
+		return err
+	}
+
+	build, err := job.GetBuild(ctx, item.Executable.Number)
+	if err != nil {
+		log.Error(ctx, "get build from jenkins failed: %v, err: %v", item.Executable.Number, err)
+		return err
+	}
+
+	setBuildDeployId(ctx, build)
+	if err = cancelBuild(ctx, build); err != nil {
+		return err
+	}
+
+	log.Info(ctx, "CancelDeploy ok: %v, taskId: %v", jobName, taskId)
+	return nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -177,3 +575,38 @@ func CdServerS3Option(s3AK, s3SK, s3Endpoint, s3Bucket, s3Region, s3getToolUrl s
 		server.s3Info = NewCdS3Info(s3AK, s3SK, s3Endpoint, s3Bucket, s3Region, s3getToolUrl)
 	}
 }
+
+//jenkins job目录，默认为空，job直接放在根目录(兼容旧版本)
+//从根目录切换到目录后，需要调用JobManager.MigrateRootJobs移动旧job，否则旧job会继续占用节点执行器
+func CdServerJobFolderOption(jobFolder string) CdServerOption {
+	return func(server *CdServer) {
+		server.jobFolder = jobFolder
+	}
+}
+
+//job默认的构建超时和构建记录保留设置，脚本中设置的值优先
+func CdServerJobOption(option *CdJobOption) CdServerOption {
+	return func(server *CdServer) {
+		server.jobOption = option
+	}
+}
+
+//所有执行器繁忙时等待空闲的超时时间和检查间隔
+func CdServerSlotWaitOption(timeout, interval time.Duration) CdServerOption {
+	return func(server *CdServer) {
+		server.slotWaitTimeout = timeout
+		if interval > 0 {
+			server.slotWaitInterval = interval
+		}
+	}
+}
+
+//部署锁和同一服务同一节点已有部署时的处理方式，默认DEPLOY_LOCK_NONE不加锁，lock为空时使用进程内锁
+func CdServerDeployLockOption(lock DeployLock, mode int) CdServerOption {
+	return func(server *CdServer) {
+		if lock != nil {
+			server.deployLock = lock
+		}
+		server.deployLockMode = mode
+	}
+}
@@ -3,15 +3,23 @@ package gocd
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/liumingmin/gojenkins"
+	"github.com/liumingmin/goutils/log"
 )
 
 const testLocalIp = "10.11.244.87" //
@@ -58,6 +66,305 @@ func TestCreateNode(t *testing.T) {
 	t.Log(err)
 }
 
+func TestCreateNodeWithLabels(t *testing.T) {
+	err := getTestCdServer().GetNodeBroker().CreateNode(context.Background(), "172.17.0.5", "172.17.0.5",
+		CdNodeCredIdOption("defssh"), CdNodeLabelsOption(map[string]string{"role": "api", "zone": "a"}))
+	t.Log(err)
+}
+
+func TestNodeSelector(t *testing.T) {
+	labels := map[string]string{"role": "api", "zone": "a", "tier": "canary"}
+	cases := map[string]bool{
+		"":                          true,
+		"role=api":                  true,
+		"role==api,zone in (a,b)":   true,
+		"role=api,zone notin (a,b)": false,
+		"role!=api":                 false,
+		"tier,!gpu":                 true,
+		"gpu":                       false,
+		"zone in (b, c)":            false,
+	}
+	for selector, expected := range cases {
+		nodeSelector, err := ParseCdNodeSelector(selector)
+		if err != nil {
+			t.Fatal(selector, err)
+		}
+		if nodeSelector.Matches(labels) != expected {
+			t.Error(selector, !expected)
+		}
+	}
+
+	for _, selector := range []string{"role=", "zone in a,b", "role=a b", "zone in (a,)"} {
+		if _, err := ParseCdNodeSelector(selector); err == nil {
+			t.Error("expected error", selector)
+		}
+	}
+
+	if label := formatNodeLabelString("10.0.0.1", labels); label != "10.0.0.1 role=api tier=canary zone=a" {
+		t.Error(label)
+	}
+
+	//master没有k=v标签，否定条件也不能选中master
+	broker := &CdNodeBroker{nodesCache: map[string]*CdNode{
+		"master":   {Node: &gojenkins.Node{Raw: &gojenkins.NodeResponse{DisplayName: "master"}}},
+		"10.0.0.1": {Node: &gojenkins.Node{Raw: &gojenkins.NodeResponse{DisplayName: "10.0.0.1", AssignedLabels: []gojenkins.NodeLabel{{Name: "tier=stable"}}}}},
+	}}
+	for _, selector := range []string{"", "tier!=canary", "role notin (db)", "!canary"} {
+		nodes, err := broker.SelectNodes(selector)
+		if err != nil || len(nodes) != 1 || nodes[0].GetName() != "10.0.0.1" {
+			t.Error(selector, nodes, err)
+		}
+	}
+	if _, err := (&CdServer{nodeBroker: broker}).DeployBySelector(context.Background(), nil, " "); !errors.Is(err, ErrInvalidParam) {
+		t.Error(err)
+	}
+}
+
+func TestDeployBySelector(t *testing.T) {
+	tasks, err := getTestCdServer().DeployBySelector(context.Background(), getTestCdService(), "role=api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		t.Log(task.NodeName, task.JobName, task.TaskId, task.Err)
+	}
+}
+
+func TestParseCdNodeMeta(t *testing.T) {
+	meta := &CdNodeMeta{Env: "prod", Ip: "10.0.0.1", Remark: "api01"}
+	parsed, legacy, err := ParseCdNodeMeta(meta.Encode())
+	if err != nil || legacy || parsed.Env != "prod" || parsed.Ip != "10.0.0.1" || parsed.Remark != "api01" {
+		t.Fatal(parsed, legacy, err)
+	}
+
+	parsed, legacy, err = ParseCdNodeMeta("production:(10.0.0.2)api02")
+	if err != nil || !legacy || parsed.Env != "production" || parsed.Ip != "10.0.0.2" || parsed.Remark != "api02" {
+		t.Fatal(parsed, legacy, err)
+	}
+
+	if _, _, err = ParseCdNodeMeta("some node"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSetXmlElement(t *testing.T) {
+	config := `<slave><description>prod:(10.0.0.1)</description><numExecutors>1</numExecutors><label/></slave>`
+	config, err := setXmlElement(config, "description", `gocd:{"env":"prod"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ = setXmlElement(config, "label", "10.0.0.1 role=api")
+	if config != `<slave><description>gocd:{&#34;env&#34;:&#34;prod&#34;}</description><numExecutors>1</numExecutors><label>10.0.0.1 role=api</label></slave>` {
+		t.Fatal(config)
+	}
+	if _, err = setXmlElement(config, "remoteFS", "/tmp"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	config = `<?xml version='1.1' encoding='UTF-8'?>
+<slave><numExecutors>2</numExecutors><launcher class="hudson.plugins.sshslaves.SSHLauncher"><port>22</port></launcher></slave>`
+	config, err = upsertXmlElement(config, "launcher", "jvmOptions", "-Xmx64m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeConfig := &cdNodeConfigXml{}
+	if err = unmarshalJenkinsXml(config, nodeConfig); err != nil {
+		t.Fatal(err)
+	}
+	if nodeConfig.NumExecutors != 2 || nodeConfig.Launcher.Port != "22" || nodeConfig.Launcher.JvmOptions != "-Xmx64m" {
+		t.Fatal(nodeConfig)
+	}
+
+	//只修改parent下的元素
+	config = `<slave><nodeProperties><port>1</port><label/></nodeProperties><launcher/><label>a</label></slave>`
+	config, err = upsertXmlElement(config, "", "label", "b")
+	if err != nil || config != `<slave><nodeProperties><port>1</port><label/></nodeProperties><launcher/><label>b</label></slave>` {
+		t.Fatal(config, err)
+	}
+	if _, err = upsertXmlElement(config, "launcher", "port", "22"); err == nil {
+		t.Fatal("expected error")
+	}
+	config, err = upsertXmlElement(config, "", "remoteFS", "/tmp")
+	if err != nil || !strings.HasSuffix(config, `<label>b</label><remoteFS>/tmp</remoteFS></slave>`) {
+		t.Fatal(config, err)
+	}
+}
+
+func TestMigrateNodes(t *testing.T) {
+	names, err := getTestCdServer().GetNodeBroker().MigrateNodes(context.Background())
+	t.Log(names, err)
+}
+
+type testSshExecutor struct {
+	scripts []string
+}
+
+//第一次检查java失败、flock无输出，之后全部通过
+func (e *testSshExecutor) Run(ctx context.Context, host, port, script string) (string, error) {
+	e.scripts = append(e.scripts, script)
+
+	var sb strings.Builder
+	for _, check := range getPreflightChecks(NewCdNodeParam(CdNodeDeployUserOption("deploy"))) {
+		if len(e.scripts) == 1 && check.name == "java" {
+			sb.WriteString(preflightLinePrefix + check.name + ":fail:\n")
+		} else if len(e.scripts) > 1 || check.name != "flock" {
+			sb.WriteString(preflightLinePrefix + check.name + ":ok:\n")
+		}
+	}
+	return sb.String(), nil
+}
+
+func TestPreflightNode(t *testing.T) {
+	broker := &CdNodeBroker{defCdNodeParam: NewCdNodeParam(), nodesCache: make(map[string]*CdNode)}
+	executor := &testSshExecutor{}
+	broker.SetSshExecutor(executor)
+
+	report, err := broker.PreflightNode(context.Background(), "172.17.0.4", CdNodeDeployUserOption("deploy"))
+	if err != nil || report.Passed() || len(report.FailedItems()) != 2 || report.FailedItems()[0].Name != "java" || report.FailedItems()[1].Name != "flock" {
+		t.Fatal(report, err)
+	}
+	t.Log(report)
+
+	script := buildInstallScript(NewCdNodeParam(), report.FailedItems())
+	if !strings.Contains(script, "gocd_install java") || !strings.Contains(script, "gocd_install flock") || strings.Contains(script, "gocd_install rsync") {
+		t.Fatal(script)
+	}
+
+	report, err = broker.PreflightNode(context.Background(), "172.17.0.4", CdNodeDeployUserOption("deploy"))
+	if err != nil || !report.Passed() {
+		t.Fatal(report, err)
+	}
+
+	checks := getPreflightChecks(NewCdNodeParam(CdNodeDeployUserOption("x;rm -rf /"), CdNodeRemoteFsOption("/var/lib/it's")))
+	for _, check := range checks {
+		if strings.Contains(check.check, "x;rm") && !strings.Contains(check.check, "'x;rm -rf /'") {
+			t.Fatal(check.check)
+		}
+	}
+	if !strings.Contains(checks[len(checks)-1].install, `'/var/lib/it'\''s'`) {
+		t.Fatal(checks[len(checks)-1].install)
+	}
+}
+
+func TestBootstrapNode(t *testing.T) {
+	report, err := getTestCdServer().GetNodeBroker().BootstrapNode(context.Background(), "172.17.0.4", "172.17.0.4",
+		CdNodeCredIdOption("defssh"), CdNodeSshUserOption("root"), CdNodeDeployUserOption("deploy"))
+	t.Log(report, err)
+}
+
+func TestParseCdInventory(t *testing.T) {
+	yamlData := `
+nodes:
+  - ip: 10.0.0.1
+    remark: api01
+    labels: {role: api, zone: a}
+    numExecutors: 2
+  - ip: 10.0.0.2
+`
+	csvData := "ip,remark,labels,numExecutors,jvmOptions\n10.0.0.1,api01,role=api;zone=a,2,\n10.0.0.2,,,,\n"
+	iniData := `
+[api]
+10.0.0.1 gocd_remark=api01 zone=a gocd_executors=2
+
+[api:vars]
+role=api
+
+[web]
+10.0.0.2 gocd_jvm_options="-Xms16m -Xmx128m"
+`
+	for format, data := range map[string]string{INVENTORY_FORMAT_YAML: yamlData, INVENTORY_FORMAT_CSV: csvData, INVENTORY_FORMAT_INI: iniData} {
+		inventory, err := ParseCdInventory([]byte(data), format)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if len(inventory.Nodes) != 2 {
+			t.Fatal(format, inventory.Nodes)
+		}
+
+		node := inventory.Nodes[0]
+		if node.Ip != "10.0.0.1" || node.Remark != "api01" || node.NumExecutors != 2 ||
+			node.Labels["role"] != "api" || node.Labels["zone"] != "a" {
+			t.Fatal(format, node)
+		}
+
+		exported, err := inventory.Marshal(format)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		reparsed, err := ParseCdInventory(exported, format)
+		if err != nil || len(reparsed.Nodes) != 2 || formatLabels(reparsed.Nodes[0].Labels) != formatLabels(node.Labels) {
+			t.Fatal(format, string(exported), err)
+		}
+	}
+
+	if _, err := ParseCdInventory([]byte("ip\n10.0.0.1\n10.0.0.1\n"), INVENTORY_FORMAT_CSV); err == nil {
+		t.Fatal("expected duplicate error")
+	}
+}
+
+func TestDiffNodeParam(t *testing.T) {
+	current := NewCdNodeParam(CdNodeLabelsOption(map[string]string{"role": "api"}))
+	desired := NewCdNodeParam(CdNodeNumExecutorsOption(3), CdNodeLabelsOption(map[string]string{"role": "web"}))
+	changes := diffNodeParam(current, desired)
+	if len(changes) != 2 {
+		t.Fatal(changes)
+	}
+	t.Log(changes)
+
+	//清单中未设置的字段保留当前值
+	current = NewCdNodeParam(CdNodeCredIdOption("defssh"), CdNodeLabelsOption(map[string]string{"role": "api"}))
+	desired = mergeInventoryNodeParam(current, &CdInventoryNode{Ip: "10.0.0.1", NumExecutors: 3})
+	changes = diffNodeParam(current, desired)
+	if len(changes) != 1 || desired.credentialsId != "defssh" || desired.labels["role"] != "api" {
+		t.Fatal(changes, desired)
+	}
+}
+
+func TestReconcileInventory(t *testing.T) {
+	inventory, err := ParseCdInventory([]byte("ip,labels,numExecutors\n172.17.0.4,role=api,5\n"), INVENTORY_FORMAT_CSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := getTestCdServer().GetNodeBroker().Reconcile(context.Background(), inventory,
+		CdReconcileDryRunOption(), CdReconcilePruneOption())
+	t.Log(plan, err)
+}
+
+func TestUpdateNode(t *testing.T) {
+	err := getTestCdServer().GetNodeBroker().UpdateNode(context.Background(), "172.17.0.4",
+		CdNodeNumExecutorsOption(3), CdNodeJvmOption("-Xms16m -Xmx128m"))
+	t.Log(err)
+}
+
+func TestIsNodeQueueItem(t *testing.T) {
+	cases := []struct {
+		taskName string
+		why      string
+		expected bool
+	}{
+		{"1-prod-runit-172.17.0.4-0", "Waiting for next available executor", true},
+		{"nightly-backup", "‘172.17.0.4’ is offline", true},
+		{"1-prod-runit-172.17.0.5-0", "‘172.17.0.5’ is offline", false},
+	}
+	for _, c := range cases {
+		if isNodeQueueItem(c.taskName, c.why, "172.17.0.4") != c.expected {
+			t.Error(c.taskName, c.why)
+		}
+	}
+}
+
+func TestDisableNode(t *testing.T) {
+	jserver := getTestCdServer()
+	err := jserver.GetNodeBroker().DisableNode(context.Background(), "172.17.0.4", "maintenance")
+	t.Log(err)
+
+	_, _, err = jserver.DeploySimple(context.Background(), getTestCdService(), "172.17.0.4")
+	t.Log(errors.Is(err, ErrNodeDisabled), err)
+
+	err = jserver.GetNodeBroker().EnableNode(context.Background(), "172.17.0.4")
+	t.Log(err)
+}
+
 func TestDeleteNode(t *testing.T) {
 	ok, err := getTestCdServer().GetNodeBroker().DeleteNode(context.Background(), "172.17.0.4")
 	t.Log(ok, err)
@@ -75,12 +382,449 @@ func TestDeploy(t *testing.T) {
 	}
 }
 
+func TestIsJobBusy(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  *gojenkins.JobResponse
+		busy bool
+	}{
+		{"new", &gojenkins.JobResponse{}, false},
+		{"queued", &gojenkins.JobResponse{InQueue: true}, true},
+		{"running", &gojenkins.JobResponse{LastBuild: gojenkins.JobBuild{Number: 5}, LastCompletedBuild: gojenkins.JobBuild{Number: 4}}, true},
+		{"completed", &gojenkins.JobResponse{LastBuild: gojenkins.JobBuild{Number: 5}, LastCompletedBuild: gojenkins.JobBuild{Number: 5}}, false},
+	}
+	for _, test := range tests {
+		if busy := isJobBusy(&gojenkins.Job{Raw: test.raw}); busy != test.busy {
+			t.Error(test.name, busy)
+		}
+	}
+}
+
+func TestWaitJobSlot(t *testing.T) {
+	busyJob := &gojenkins.Job{Raw: &gojenkins.JobResponse{InQueue: true}}
+	idleJob := &gojenkins.Job{Raw: &gojenkins.JobResponse{}}
+	node := &CdNode{Node: &gojenkins.Node{Raw: &gojenkins.NodeResponse{DisplayName: "172.17.0.4", NumExecutors: 3}}}
+
+	tests := []struct {
+		name    string
+		jobs    []*gojenkins.Job // 每个执行器的job，第二轮检查时全部空闲
+		slotIdx int64
+		err     error
+	}{
+		{"first idle", []*gojenkins.Job{idleJob, busyJob, idleJob}, 0, nil},
+		{"skip busy", []*gojenkins.Job{busyJob, busyJob, idleJob}, 2, nil},
+		{"all busy then idle", []*gojenkins.Job{busyJob, busyJob, busyJob}, 0, nil},
+		{"all busy timeout", []*gojenkins.Job{busyJob, busyJob, busyJob}, -1, ErrQueueTimeout},
+	}
+	for _, test := range tests {
+		cdServer := &CdServer{slotWaitTimeout: 50 * time.Millisecond, slotWaitInterval: 10 * time.Millisecond}
+		if test.err != nil {
+			cdServer.slotWaitTimeout = 0
+		}
+
+		checked := 0
+		jobName, job, err := cdServer.waitJobSlot(context.Background(), node, func(idx int64) (string, *gojenkins.Job, error) {
+			checked++
+			if checked > len(test.jobs) && test.err == nil {
+				return fmt.Sprint(idx), idleJob, nil
+			}
+			return fmt.Sprint(idx), test.jobs[idx], nil
+		})
+		if !errors.Is(err, test.err) {
+			t.Fatal(test.name, err)
+		}
+		if test.err == nil && (job != idleJob || jobName != fmt.Sprint(test.slotIdx)) {
+			t.Fatal(test.name, jobName)
+		}
+	}
+}
+
+func TestDeployLock(t *testing.T) {
+	ctx := context.Background()
+	locks := []DeployLock{NewMemDeployLock(), NewFileDeployLock(t.TempDir())}
+	for _, lock := range locks {
+		ok, err := lock.Acquire(ctx, "prod/runit/172.17.0.4", "a")
+		if !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+		ok, _ = lock.Acquire(ctx, "prod/runit/172.17.0.4", "b")
+		owner, _ := lock.Owner(ctx, "prod/runit/172.17.0.4")
+		if ok || owner != "a" {
+			t.Fatal(ok, owner)
+		}
+
+		lock.Release(ctx, "prod/runit/172.17.0.4", "b")
+		owner, _ = lock.Owner(ctx, "prod/runit/172.17.0.4")
+		if owner != "a" {
+			t.Fatal(owner)
+		}
+
+		lock.Release(ctx, "prod/runit/172.17.0.4", "a")
+		ok, _ = lock.Acquire(ctx, "prod/runit/172.17.0.4", "b")
+		if !ok {
+			t.Fatal(lock)
+		}
+	}
+
+	jobFullName, lockTime := parseDeployLockOwner(formatDeployLockOwner("gocd/prod/runit/1-prod-runit-172.17.0.4-0", time.Unix(1600000000, 0)))
+	if jobFullName != "gocd/prod/runit/1-prod-runit-172.17.0.4-0" || lockTime.Unix() != 1600000000 {
+		t.Fatal(jobFullName, lockTime)
+	}
+
+	//构建结束后释放本次部署的锁，不释放构建结束后其他部署获取的锁
+	cdServer := &CdServer{env: "prod", deployLock: NewMemDeployLock(), deployLockMode: DEPLOY_LOCK_WAIT,
+		nodeBroker: &CdNodeBroker{nodesCache: make(map[string]*CdNode)}}
+	key := "prod/runit/172.17.0.4"
+	startedAt := time.Unix(1600000010, 0)
+	cdServer.deployLock.Acquire(ctx, key, formatDeployLockOwner(jobFullName, startedAt.Add(time.Minute)))
+	cdServer.releaseFinishedDeployLock(ctx, jobFullName, &DeployResult{Status: RUN_STATUS_SUCCESS, StartedAt: startedAt})
+	if owner, _ := cdServer.deployLock.Owner(ctx, key); owner == "" {
+		t.Fatal("released newer lock")
+	}
+
+	cdServer.deployLock.Release(ctx, key, formatDeployLockOwner(jobFullName, startedAt.Add(time.Minute)))
+	cdServer.deployLock.Acquire(ctx, key, formatDeployLockOwner(jobFullName, time.Unix(1600000000, 0)))
+	cdServer.releaseFinishedDeployLock(ctx, jobFullName, &DeployResult{Status: RUN_STATUS_RUNNING, StartedAt: startedAt})
+	if owner, _ := cdServer.deployLock.Owner(ctx, key); owner == "" {
+		t.Fatal("released running lock")
+	}
+	cdServer.releaseFinishedDeployLock(ctx, jobFullName, &DeployResult{Status: RUN_STATUS_FAILED, StartedAt: startedAt})
+	if owner, _ := cdServer.deployLock.Owner(ctx, key); owner != "" {
+		t.Fatal(owner)
+	}
+
+	//查询状态不加锁，supersede模式下部署以外的操作等待已有部署
+	cdServer.deployLockMode = DEPLOY_LOCK_SUPERSEDE
+	node := &CdNode{Node: &gojenkins.Node{Raw: &gojenkins.NodeResponse{DisplayName: "172.17.0.4"}}}
+	svc := &DefaultCdService{name: "runit"}
+	cdServer.deployLock.Acquire(ctx, key, formatDeployLockOwner(jobFullName, time.Now()))
+	if owner, err := cdServer.lockDeploy(ctx, svc, node, jobFullName, ACTION_STATUS); owner != "" || err != nil {
+		t.Fatal(owner, err)
+	}
+	if _, err := cdServer.lockDeploy(ctx, svc, node, jobFullName, ACTION_RESTART); !errors.Is(err, ErrDeployLocked) {
+		t.Fatal(err)
+	}
+}
+
+func TestDeployWaitLock(t *testing.T) {
+	jserver := getTestCdServer()
+	CdServerDeployLockOption(nil, DEPLOY_LOCK_WAIT)(jserver)
+	svc := getTestCdService()
+	for i := 0; i < 2; i++ {
+		jobName, taskId, err := jserver.DeploySimple(context.Background(), svc, "172.17.0.4")
+		t.Log(jobName, taskId, err)
+	}
+}
+
+func TestParseCdJobName(t *testing.T) {
+	jobName, err := ParseCdJobName("1-prod-user-api-172.17.0.4-2", "prod", []string{"172.17.0.4"})
+	if err != nil || jobName.ScriptVersion != 1 || jobName.Service != "user-api" || jobName.Node != "172.17.0.4" || jobName.Idx != 2 {
+		t.Fatal(jobName, err)
+	}
+
+	jobName, err = ParseCdJobName("3-prod-runit-web-01-0", "prod", []string{"web-01", "01"})
+	if err != nil || jobName.Service != "runit" || jobName.Node != "web-01" {
+		t.Fatal(jobName, err)
+	}
+
+	jobName, err = ParseCdJobName("3-prod-runit-deleted-0", "prod", nil)
+	if err != nil || jobName.Service != "runit" || jobName.Node != "deleted" {
+		t.Fatal(jobName, err)
+	}
+
+	for _, name := range []string{"1-production-runit-172.17.0.4-0", "x-prod-runit-172.17.0.4-0", "1-prod-runit-0", "freestyle"} {
+		if _, err = ParseCdJobName(name, "prod", nil); err == nil {
+			t.Error("expected error", name)
+		}
+	}
+
+	if name := formatJobName(1, "prod", "runit", "172.17.0.4", 0); name != "1-prod-runit-172.17.0.4-0" {
+		t.Error(name)
+	}
+
+	//根目录下名称格式相同的其他job不是gocd创建的
+	jobManager := (&CdServer{env: "prod", nodeBroker: &CdNodeBroker{nodesCache: map[string]*CdNode{
+		"172.17.0.4": {Node: &gojenkins.Node{Raw: &gojenkins.NodeResponse{DisplayName: "172.17.0.4", NumExecutors: 2}}},
+	}}}).GetJobManager()
+	jobName, _ = ParseCdJobName("1-prod-nightly-backup-3", "prod", nil)
+	if jobManager.isCdJob(jobName, &gojenkins.Job{Raw: &gojenkins.JobResponse{Description: "nightly backup"}}) {
+		t.Error(jobName)
+	}
+	//旧版本创建的job没有描述，按本环境节点名称匹配
+	jobName, _ = ParseCdJobName("1-prod-runit-172.17.0.4-0", "prod", jobManager.server.nodeBroker.getNodeNames())
+	if !jobManager.isCdJob(jobName, &gojenkins.Job{Raw: &gojenkins.JobResponse{}}) {
+		t.Error(jobName)
+	}
+	jobName, _ = ParseCdJobName("1-prod-nightly-backup-3", "prod", nil)
+	if !jobManager.isCdJob(jobName, &gojenkins.Job{Raw: &gojenkins.JobResponse{Description: formatJobDescription("prod", "abc")}}) {
+		t.Error(jobName)
+	}
+	jobName.Parents = []string{DEFAULT_JOB_FOLDER, "prod", "nightly"}
+	if !jobManager.isCdJob(jobName, &gojenkins.Job{Raw: &gojenkins.JobResponse{}}) {
+		t.Error(jobName)
+	}
+
+	//prod-eu环境的job按prod前缀也能解析，按描述中的环境排除
+	jobName, _ = ParseCdJobName("1-prod-eu-api-10.0.0.9-0", "prod", nil)
+	if jobName == nil || jobName.Service != "eu-api" {
+		t.Fatal(jobName)
+	}
+	if jobManager.isCdJob(jobName, &gojenkins.Job{Raw: &gojenkins.JobResponse{Description: formatJobDescription("prod-eu", "abc")}}) {
+		t.Error(jobName)
+	}
+	if env, ok := parseJobDescriptionEnv(formatJobDescription("prod-eu", "abc")); !ok || env != "prod-eu" {
+		t.Error(env, ok)
+	}
+	//未记录环境时按节点是否属于本环境判断
+	if jobManager.isCdJob(jobName, &gojenkins.Job{Raw: &gojenkins.JobResponse{Description: configHashPrefix + "abc"}}) {
+		t.Error(jobName)
+	}
+	jobName, _ = ParseCdJobName("1-prod-runit-172.17.0.4-0", "prod", jobManager.server.nodeBroker.getNodeNames())
+	if !jobManager.isCdJob(jobName, &gojenkins.Job{Raw: &gojenkins.JobResponse{Description: configHashPrefix + "abc"}}) {
+		t.Error(jobName)
+	}
+}
+
+func TestJobFullName(t *testing.T) {
+	cdServer := &CdServer{env: "prod", jobFolder: DEFAULT_JOB_FOLDER}
+	parents := cdServer.getJobParents("runit")
+	fullName := formatJobFullName("1-prod-runit-172.17.0.4-0", parents)
+	if fullName != "gocd/prod/runit/1-prod-runit-172.17.0.4-0" {
+		t.Fatal(fullName)
+	}
+
+	jobName, splitParents := splitJobFullName(fullName)
+	if jobName != "1-prod-runit-172.17.0.4-0" || strings.Join(splitParents, "/") != "gocd/prod/runit" {
+		t.Fatal(jobName, splitParents)
+	}
+
+	jobName, splitParents = splitJobFullName("1-prod-runit-172.17.0.4-0")
+	if jobName != "1-prod-runit-172.17.0.4-0" || len(splitParents) != 0 {
+		t.Fatal(jobName, splitParents)
+	}
+
+	cdServer.jobFolder = ""
+	if parents = cdServer.getJobParents("runit"); len(parents) != 0 {
+		t.Fatal(parents)
+	}
+}
+
+func TestMigrateRootJobs(t *testing.T) {
+	cdServer := getTestCdServer()
+	CdServerJobFolderOption(DEFAULT_JOB_FOLDER)(cdServer)
+	jobNames, err := cdServer.GetJobManager().MigrateRootJobs(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, jobName := range jobNames {
+		t.Log(jobName.FullName())
+	}
+}
+
+func TestJobGC(t *testing.T) {
+	items, err := getTestCdServer().GetJobManager().GC(context.Background(), []CdService{getTestCdService()}, CdJobGcDryRunOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		t.Log(item.Job.Name, item.Reason)
+	}
+}
+
 func TestGetTaskBuild(t *testing.T) {
 	build, _ := getTestCdServer().GetDeployResult(context.Background(), "1-prod-runit-172.17.0.4-1", 138)
 	bs, _ := json.Marshal(build)
 	t.Log(string(bs))
 }
 
+func TestCancelDeploy(t *testing.T) {
+	jserver := getTestCdServer()
+	jobName, taskId, err := jserver.DeploySimple(context.Background(), getTestCdService(), "172.17.0.4")
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	err = jserver.CancelDeploy(context.Background(), jobName, taskId)
+	t.Log(err)
+
+	result, err := jserver.GetDeployResult(context.Background(), jobName, taskId)
+	t.Log(result, err)
+}
+
+func TestParseDeployMarkers(t *testing.T) {
+	output := `gocd:stage:download:1600000000000
+gocd: downloading s3get...
+gocd:stage:extract:1600000002000
+gocd:stage:sync:1600000002500
+gocd:stage:run:1600000003000
+gocd:exit:1:1600000004000
+`
+	markers := parseDeployMarkers(output)
+	if len(markers.stages) != 4 || markers.exitCode != 1 || markers.finishedAt.UnixNano()/int64(time.Millisecond) != 1600000004000 {
+		t.Fatal(markers)
+	}
+	if markers.stages[0].Name != "download" || markers.stages[0].Duration != 2*time.Second || !markers.stages[0].Finished {
+		t.Fatal(markers.stages[0])
+	}
+	if markers.stages[3].Name != "run" || markers.stages[3].Duration != time.Second || markers.stages[3].Finished {
+		t.Fatal(markers.stages[3])
+	}
+
+	markers = parseDeployMarkers("gocd:stage:run:1600000003000\n")
+	if markers.exitCode != -1 || markers.stages[0].Finished {
+		t.Fatal(markers)
+	}
+}
+
+func TestDeployResultErr(t *testing.T) {
+	markers := parseDeployMarkers("gocd:stage:run:1600000003000\ngocd:fail:RUN_CMD_FAILED:run.sh\ngocd:exit:2:1600000004000\n")
+	result := &DeployResult{Status: RUN_STATUS_FAILED, ExitCode: markers.exitCode, FailCode: markers.failCode, FailDetail: markers.failDetail}
+
+	err := result.Err()
+	var deployErr *DeployError
+	if !errors.Is(err, ErrRunCmdFailed) || !errors.As(err, &deployErr) || deployErr.Detail != "run.sh" || deployErr.ExitCode != 2 {
+		t.Fatal(err)
+	}
+
+	result = &DeployResult{Status: RUN_STATUS_FAILED, ExitCode: 1}
+	if !errors.Is(result.Err(), ErrDeployFailed) {
+		t.Fatal(result.Err())
+	}
+	result = &DeployResult{Status: RUN_STATUS_CANCELLED}
+	if !errors.Is(result.Err(), ErrDeployCancelled) {
+		t.Fatal(result.Err())
+	}
+	result = &DeployResult{Status: RUN_STATUS_ABORTED}
+	if !errors.Is(result.Err(), ErrDeployAborted) {
+		t.Fatal(result.Err())
+	}
+
+	tests := []struct {
+		result      string
+		description interface{}
+		status      int
+	}{
+		{gojenkins.STATUS_SUCCESS, nil, RUN_STATUS_SUCCESS},
+		{gojenkins.STATUS_FAIL, nil, RUN_STATUS_FAILED},
+		{"UNSTABLE", nil, RUN_STATUS_UNSTABLE},
+		{gojenkins.STATUS_ABORTED, nil, RUN_STATUS_ABORTED},
+		{gojenkins.STATUS_ABORTED, "GOCD_DEPLOY_ID=1 " + deployCancelledMarker, RUN_STATUS_CANCELLED},
+	}
+	for _, test := range tests {
+		build := &gojenkins.Build{Raw: &gojenkins.BuildResponse{Result: test.result, Description: test.description}}
+		if status := getFinishedBuildStatus(build); status != test.status {
+			t.Error(test.result, test.description, status)
+		}
+	}
+	result = &DeployResult{Status: RUN_STATUS_SUCCESS}
+	if result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+}
+
+func TestDeployment(t *testing.T) {
+	jserver := getTestCdServer()
+	deployment, err := jserver.Deploy(context.Background(), getTestCdService(), "172.17.0.4")
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	loaded, err := jserver.LoadDeployment(deployment.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loaded.Logs(context.Background(), os.Stdout)
+	t.Log(err)
+
+	result, err := loaded.Wait(context.Background())
+	t.Log(result, err)
+}
+
+func TestLoadDeployment(t *testing.T) {
+	jserver := &CdServer{}
+	deployment, err := jserver.LoadDeployment("gocd/prod/runit/1-prod-runit-172.17.0.4-0#138")
+	if err != nil || deployment.JobName() != "gocd/prod/runit/1-prod-runit-172.17.0.4-0" || deployment.TaskId() != 138 {
+		t.Fatal(deployment, err)
+	}
+	if deployment.ID() != "gocd/prod/runit/1-prod-runit-172.17.0.4-0#138" {
+		t.Fatal(deployment.ID())
+	}
+
+	deployment, err = jserver.LoadDeployment("gocd/prod/runit/1-prod-runit-172.17.0.4-0#138#" + NewDeployId())
+	if err != nil || deployment.TaskId() != 138 || len(deployment.DeployId()) != 23 {
+		t.Fatal(deployment, err)
+	}
+	loaded, _ := jserver.LoadDeployment(deployment.ID())
+	if loaded.DeployId() != deployment.DeployId() {
+		t.Fatal(loaded.ID())
+	}
+
+	for _, id := range []string{"", "#1", "job#", "job#x", "job#0", "job#1#a#b"} {
+		if _, err = jserver.LoadDeployment(id); err == nil {
+			t.Fatal(id)
+		}
+	}
+}
+
+func TestDeployIdCtx(t *testing.T) {
+	ctx := withDeployIdCtx(context.Background(), "20261019120000-a1b2c3d4")
+	if ctx.Value(log.LOG_TRADE_ID) != "20261019120000-a1b2c3d4" {
+		t.Fatal(ctx.Value(log.LOG_TRADE_ID))
+	}
+
+	ctx = withDeployIdCtx(context.WithValue(context.Background(), log.LOG_TRADE_ID, "req1"), "20261019120000-a1b2c3d4")
+	ctx = withDeployIdCtx(ctx, "20261019120000-a1b2c3d4")
+	if ctx.Value(log.LOG_TRADE_ID) != "req1,20261019120000-a1b2c3d4" {
+		t.Fatal(ctx.Value(log.LOG_TRADE_ID))
+	}
+}
+
+func TestBuildDeployId(t *testing.T) {
+	raw := &gojenkins.BuildResponse{}
+	if err := json.Unmarshal([]byte(`{"number":138,"description":"gocd:cancelled","actions":[{},{"parameters":[{"name":"GOCD_DEPLOY_ID","value":"20261019120000-a1b2c3d4"}]}]}`), raw); err != nil {
+		t.Fatal(err)
+	}
+	build := &gojenkins.Build{Raw: raw}
+	if deployId := getBuildDeployId(build); deployId != "20261019120000-a1b2c3d4" {
+		t.Fatal(deployId)
+	}
+
+	//已有描述时不修改，不请求jenkins
+	setBuildDeployId(context.Background(), build)
+	if build.Raw.Description != "gocd:cancelled" {
+		t.Fatal(build.Raw.Description)
+	}
+}
+
+func TestBuildCache(t *testing.T) {
+	cache := &cdBuildCache{}
+	if cache.load("job#1") != nil {
+		t.Fatal("empty cache")
+	}
+
+	for idx := 1; idx <= maxResolvedBuilds+1; idx++ {
+		cache.store(formatBuildKey("job", int64(idx)), &cdQueueItem{ID: int64(idx)})
+	}
+	if len(cache.builds) != maxResolvedBuilds {
+		t.Fatal(len(cache.builds))
+	}
+	if item := cache.load(formatBuildKey("job", maxResolvedBuilds+1)); item == nil || item.ID != maxResolvedBuilds+1 {
+		t.Fatal(item)
+	}
+
+	cache.builds[formatBuildKey("job", 2)].resolvedAt = time.Now().Add(-resolvedBuildTTL - time.Minute)
+	if cache.load(formatBuildKey("job", 2)) != nil {
+		t.Fatal("expired")
+	}
+}
+
+func TestGetDeployResultByDeployId(t *testing.T) {
+	result, err := getTestCdServer().GetDeployResultByDeployId(context.Background(), "gocd/prod/runit/1-prod-runit-172.17.0.4-0", "20261019120000-a1b2c3d4")
+	t.Log(result, err)
+}
+
 func TestS3Get(t *testing.T) {
 	sess, _ := session.NewSession(&aws.Config{
 		Credentials: credentials.NewStaticCredentials("Vg6p9p/WM55ZbiZkE8Vyzw==",
@@ -116,3 +860,451 @@ func TestNewDefaultCdScript(t *testing.T) {
 	scriptConfig, _ := cdScript.GetCdTaskScriptConfig("127.0.0.1")
 	t.Log(scriptConfig)
 }
+
+func TestCdScriptLibrary(t *testing.T) {
+	services := []CdService{
+		getTestCdService(),
+		NewSystemdCdService("runit", "pkg.tgz", "/tmp/test", "run.sh", "", map[string]string{"A": "1"}),
+		NewSupervisorCdService("runit", "pkg.tgz", "/tmp/test", "run.sh", "", map[string]string{"A": "1"}),
+		NewDockerCdService("runit", "nginx:latest", "-p 8080:80", "", map[string]string{"A": "1"}),
+	}
+	for _, service := range services {
+		config, err := service.GetCdScript().GetCdTaskScriptConfig("127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name := range service.GetParams() {
+			if !strings.Contains(config, "<name>"+name+"</name>") {
+				t.Fatal(name)
+			}
+		}
+
+		cmd := exec.Command("bash", "-n")
+		cmd.Stdin = strings.NewReader(service.GetCdScript().scriptContent)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(string(output), err)
+		}
+	}
+
+	if formatEnvVar(map[string]string{"B": "2", "A": "1"}) != " A=1 B=2" {
+		t.Fatal(formatEnvVar(map[string]string{"B": "2", "A": "1"}))
+	}
+}
+
+func TestCdScriptBuilder(t *testing.T) {
+	builder := NewDefaultCdScriptBuilder()
+	builder.InsertStageBefore(STAGE_RUN, &CdScriptStage{Name: "migrate", Content: "    /bin/bash ${CURRENT_LINK}/migrate.sh"}).
+		ReplaceStage(&CdScriptStage{Name: STAGE_VERIFY, FailCode: FAIL_CODE_PACKAGE_DOWNLOAD, Content: "    tar -tzf ${RELEASE_DIR}.tgz >/dev/null"}).
+		RemoveStage(STAGE_SYNC).
+		AddStage(&CdScriptStage{Name: STAGE_HEALTH_CHECK, FailCode: FAIL_CODE_HEALTH_CHECK, Content: "    curl -sf http://127.0.0.1:8080/health"})
+
+	names := strings.Join(builder.StageNames(), ",")
+	if names != "fetch_tool,download,verify,extract,pre_hook,post_hook,pre_start,migrate,run,health_check" {
+		t.Fatal(names)
+	}
+
+	content := builder.Render()
+	if !strings.Contains(content, "gocd_run_stage migrate RUN_CMD_FAILED\ngocd_run_stage run RUN_CMD_FAILED\ngocd_run_stage health_check HEALTH_CHECK\n") ||
+		strings.Contains(content, "gocd_run_stage sync") || !strings.Contains(content, "gocd_run_stage pre_hook HOOK_FAILED") ||
+		!strings.Contains(content, "tar -tzf ${RELEASE_DIR}.tgz") {
+		t.Fatal(content)
+	}
+
+	cmd := exec.Command("bash", "-n")
+	cmd.Stdin = strings.NewReader(content)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatal(string(output), err)
+	}
+
+	svc := NewDefaultCdService("test", "pkg.tgz", "/tmp/test", "run.sh", nil)
+	svc.(*DefaultCdService).UpdateCdScript(MustCdScript(builder.Build()))
+	if svc.GetCdScript() == nil || svc.GetCdScript().scriptContent != content {
+		t.Fatal("update script")
+	}
+
+	if _, err := NewDefaultCdScriptBuilder().RemoveStage("pre_stop").Build(); !errors.Is(err, ErrInvalidScript) {
+		t.Fatal("remove unknown stage", err)
+	}
+	if _, err := NewDefaultCdScriptBuilder().AddStage(&CdScriptStage{Name: "pre-stop"}).Build(); !errors.Is(err, ErrInvalidScript) {
+		t.Fatal("invalid stage name", err)
+	}
+	if _, err := NewDefaultCdScriptBuilder().AddStage(&CdScriptStage{Name: STAGE_RUN}).Build(); !errors.Is(err, ErrInvalidScript) {
+		t.Fatal("duplicate stage", err)
+	}
+}
+
+func TestPackageHooks(t *testing.T) {
+	pkgDir := t.TempDir()
+	os.MkdirAll(filepath.Join(pkgDir, "gocd"), 0755)
+	ioutil.WriteFile(filepath.Join(pkgDir, "gocd", "post_install.sh"), []byte("[[ \"${APP_MODE}\" == \"migrate\" ]] && exit 3\n"), 0644)
+
+	script := taskScriptFuncs + taskScriptPackagePrelude + "gocd_run_hook pre_install " + pkgDir + "\ngocd_run_hook post_install " + pkgDir + "\n"
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Env = append(os.Environ(), "ENV_VAR= APP_MODE=migrate")
+	output, _ := cmd.CombinedOutput()
+
+	markers := parseDeployMarkers(string(output))
+	if markers.failCode != FAIL_CODE_HOOK_FAILED || markers.failDetail != "post_install.sh" || markers.exitCode != 3 {
+		t.Fatal(string(output))
+	}
+
+	cmd = exec.Command("bash", "-c", script)
+	cmd.Env = append(os.Environ(), "ENV_VAR= APP_MODE=migrate", "HOOKS_ENABLED=false")
+	output, _ = cmd.CombinedOutput()
+	if markers = parseDeployMarkers(string(output)); markers.failCode != "" || markers.exitCode != 0 {
+		t.Fatal(string(output))
+	}
+
+	err := (&DeployResult{Status: RUN_STATUS_ERR, ExitCode: 3, FailCode: FAIL_CODE_HOOK_FAILED, FailDetail: "post_install.sh"}).Err()
+	if !errors.Is(err, ErrHookFailed) || !strings.Contains(err.Error(), "post_install.sh") {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseSwitch(t *testing.T) {
+	targetPath := t.TempDir()
+	runScript := func(env []string, cmds string) string {
+		cmd := exec.Command("bash", "-c", taskScriptFuncs+taskScriptPackagePrelude+cmds)
+		cmd.Env = append(append(os.Environ(), "TARGET_PATH="+targetPath), env...)
+		output, _ := cmd.CombinedOutput()
+		return string(output)
+	}
+
+	//模拟3次部署和1次解压后失败的部署
+	for _, release := range []string{"20261019120000-a", "20261019130000-b", "20261019140000-c", "20261019150000-d"} {
+		runScript([]string{"GOCD_DEPLOY_ID=" + release, "KEEP_RELEASES=2"}, "mkdir -p ${RELEASE_DIR}\n")
+		if release != "20261019150000-d" {
+			runScript([]string{"GOCD_DEPLOY_ID=" + release, "KEEP_RELEASES=2"}, "touch ${RELEASE_DIR}/.gocd_released\ngocd_switch_release $(basename ${RELEASE_DIR})\ngocd_clean_releases\n")
+		}
+	}
+
+	releases, _ := ioutil.ReadDir(filepath.Join(targetPath, "releases"))
+	if len(releases) != 3 || releases[0].Name() != "20261019130000-b" {
+		t.Fatal(releases)
+	}
+	if link, _ := os.Readlink(filepath.Join(targetPath, "current")); link != "releases/20261019140000-c" {
+		t.Fatal(link)
+	}
+
+	output := runScript(nil, "gocd_rollback\n")
+	if link, _ := os.Readlink(filepath.Join(targetPath, "current")); link != "releases/20261019130000-b" {
+		t.Fatal(output, link)
+	}
+
+	markers := parseDeployMarkers(runScript(nil, "gocd_rollback\n"))
+	if markers.failCode != FAIL_CODE_RELEASE_NOT_FOUND {
+		t.Fatal(markers.failCode)
+	}
+
+	runScript([]string{"ROLLBACK_RELEASE=20261019140000-c"}, "gocd_rollback\n")
+	if link, _ := os.Readlink(filepath.Join(targetPath, "current")); link != "releases/20261019140000-c" {
+		t.Fatal(link)
+	}
+}
+
+func TestRemoveTarget(t *testing.T) {
+	runScript := func(targetPath, cmds string) string {
+		cmd := exec.Command("bash", "-c", taskScriptFuncs+taskScriptPackagePrelude+cmds)
+		cmd.Env = append(os.Environ(), "TARGET_PATH="+targetPath)
+		output, _ := cmd.CombinedOutput()
+		return string(output)
+	}
+
+	//非gocd部署的目录不删除
+	otherPath := t.TempDir()
+	ioutil.WriteFile(filepath.Join(otherPath, "data"), []byte("data"), 0644)
+	for _, targetPath := range []string{otherPath, "", "//"} {
+		markers := parseDeployMarkers(runScript(targetPath, "gocd_remove_target\n"))
+		if markers.failCode != FAIL_CODE_INVALID_TARGET {
+			t.Fatal(targetPath, markers.failCode)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(otherPath, "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	targetPath := filepath.Join(t.TempDir(), "runit")
+	runScript(targetPath, "mkdir -p ${RELEASE_DIR} && touch ${RELEASE_DIR}/.gocd_released && gocd_switch_release $(basename ${RELEASE_DIR})\n")
+	output := runScript(targetPath, "gocd_remove_target\n")
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Fatal(output, err)
+	}
+}
+
+func TestPidActions(t *testing.T) {
+	targetPath := t.TempDir()
+	runScript := func(cmds string) *cdDeployMarkers {
+		cmd := exec.Command("bash", "-c", taskScriptFuncs+taskScriptPackagePrelude+taskScriptPidPrelude+cmds)
+		cmd.Env = append(os.Environ(), "TARGET_PATH="+targetPath, "STOP_WAIT_SECONDS=5")
+		output, _ := cmd.CombinedOutput()
+		return parseDeployMarkers(string(output))
+	}
+
+	if markers := runScript("gocd_pid_status\n"); markers.status == nil || markers.status.State != SERVICE_STATE_UNKNOWN {
+		t.Fatal(markers.status)
+	}
+	if markers := runScript("gocd_stop_pid\n"); markers.failCode != FAIL_CODE_UNSUPPORTED_ACTION {
+		t.Fatal(markers.failCode)
+	}
+
+	//模拟RUN_CMD启动后台进程并写入pid
+	runScript("nohup sleep 60 >/dev/null 2>&1 &\necho $! > ${GOCD_PID_FILE}\n")
+	if markers := runScript("gocd_pid_status\n"); markers.status == nil || markers.status.State != SERVICE_STATE_RUNNING {
+		t.Fatal(markers.status)
+	}
+	if markers := runScript("gocd_stop_pid\n"); markers.failCode != "" {
+		t.Fatal(markers.failCode)
+	}
+	if _, err := os.Stat(filepath.Join(targetPath, "gocd.pid")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	script := NewDefaultCdScriptBuilder().Render()
+	for _, action := range []string{ACTION_STOP, ACTION_RESTART, ACTION_STATUS} {
+		if !strings.Contains(script, "    "+action+")\n") {
+			t.Error(action)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	svc := NewSystemdCdService("runit", "pkg.tgz", "/tmp/test", "run.sh", "", map[string]string{"A": "1"})
+	result, err := getTestCdServer().Rollback(context.Background(), svc, "172.17.0.4", "")
+	t.Log(result, err)
+}
+
+func TestCdScriptValidate(t *testing.T) {
+	for _, cdScript := range []*CdScript{NewDefaultCdScript(), NewSystemdCdScript(), NewSupervisorCdScript(), NewDockerCdScript()} {
+		if err := cdScript.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewCdScript(nil, "<project>{{.ScriptContent}}</project>", DefaultTaskScript, 0); !errors.Is(err, ErrInvalidScript) {
+		t.Fatal(err)
+	}
+	if _, err := NewCdScript(nil, "{{.ScriptContent", DefaultTaskScript, 0); !errors.Is(err, ErrInvalidScript) {
+		t.Fatal(err)
+	}
+
+	cdatas := MustCdScript(NewCdScript(nil, DefaultXmlTpl, "echo ']]>'\n", 0))
+	if err := cdatas.Validate(); !errors.Is(err, ErrInvalidScript) {
+		t.Fatal(err)
+	}
+
+	syntax := MustCdScript(NewCdScript(nil, DefaultXmlTpl, "if [[ -f /tmp/x ]]; then\necho x\n", 0))
+	if err := syntax.Validate(); !errors.Is(err, ErrInvalidScript) || !strings.Contains(err.Error(), "bash -n") {
+		t.Fatal(err)
+	}
+}
+
+func TestPipelineCdScript(t *testing.T) {
+	builder := NewSystemdCdScriptBuilder().Pipeline(&CdPipelineOption{Lock: "runit-deploy"})
+	builder.GetStage(STAGE_DOWNLOAD).Retry = 2
+	builder.GetStage(STAGE_HEALTH_CHECK).Timeout = time.Minute
+	cdScript, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cdScript.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cdScript.pipelineShells) == 0 {
+		t.Fatal("no pipeline shells")
+	}
+
+	broken := *cdScript
+	broken.pipelineShells = append([]string{"if [[ -f /tmp/x ]]; then\n"}, cdScript.pipelineShells...)
+	if err = broken.Validate(); !errors.Is(err, ErrInvalidScript) || !strings.Contains(err.Error(), "pipeline stage 0") {
+		t.Fatal(err)
+	}
+
+	config, err := cdScript.GetCdTaskScriptConfig("172.17.0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"<flow-definition", "agent { label &apos;172.17.0.4&apos; }", "lock(resource: &apos;runit-deploy&apos;)",
+		"stage(&apos;health_check&apos;)", "timeout(time: 60, unit: &apos;SECONDS&apos;)", "retry(3)", `tr \&apos;\\n\&apos; \&apos; \&apos;`} {
+		if !strings.Contains(config, expect) {
+			t.Fatal(expect, config)
+		}
+	}
+	if !strings.Contains(config, "stage(&apos;pre_hook&apos;) {") || strings.Contains(config, pipelineNodePlaceholder) {
+		t.Fatal(config)
+	}
+}
+
+func TestCdJobOption(t *testing.T) {
+	serverOption := &CdJobOption{Timeout: 10 * time.Minute, NumToKeep: 20}
+	cdScript := MustCdScript(NewDefaultCdScriptBuilder().JobOption(&CdJobOption{Timeout: 90 * time.Second, ArtifactDaysToKeep: 3}).Build())
+	if err := cdScript.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config, hash, err := cdScript.getCdTaskScriptConfigWithHash("127.0.0.1", "", serverOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"<timeoutMinutes>2</timeoutMinutes>", "<numToKeep>20</numToKeep>",
+		"<daysToKeep>-1</daysToKeep>", "<artifactDaysToKeep>3</artifactDaysToKeep>"} {
+		if !strings.Contains(config, expect) {
+			t.Fatal(expect, config)
+		}
+	}
+
+	//脚本取消服务端超时和保留设置
+	unlimited := MustCdScript(NewDefaultCdScriptBuilder().JobOption(&CdJobOption{Timeout: JOB_OPTION_UNLIMITED, NumToKeep: JOB_OPTION_UNLIMITED}).Build())
+	config, _, _ = unlimited.getCdTaskScriptConfigWithHash("127.0.0.1", "", serverOption)
+	if strings.Contains(config, "BuildTimeoutWrapper") || strings.Contains(config, "BuildDiscarderProperty") {
+		t.Fatal(config)
+	}
+
+	config, hash2, _ := NewDefaultCdScript().getCdTaskScriptConfigWithHash("127.0.0.1", "", nil)
+	if hash == hash2 || strings.Contains(config, "BuildTimeoutWrapper") || strings.Contains(config, "BuildDiscarderProperty") {
+		t.Fatal(config)
+	}
+
+	pipelineScript := MustCdScript(NewSystemdCdScriptBuilder().Pipeline(nil).Build())
+	config, _, err = pipelineScript.getCdTaskScriptConfigWithHash("127.0.0.1", "", serverOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "timeout(time: 600, unit: &apos;SECONDS&apos;)") || !strings.Contains(config, "<numToKeep>20</numToKeep>") ||
+		strings.Contains(config, pipelineTimeoutPlaceholder) {
+		t.Fatal(config)
+	}
+	config, _, _ = pipelineScript.getCdTaskScriptConfigWithHash("127.0.0.1", "", nil)
+	if strings.Contains(config, "__GOCD_TIMEOUT__") || strings.Contains(config, "timeout(time:") {
+		t.Fatal(config)
+	}
+}
+
+func TestDeployPipeline(t *testing.T) {
+	svc := NewSystemdCdService("runit", "pkg.tgz", "/tmp/test", "run.sh", "", map[string]string{"A": "1"})
+	svc.(*DefaultCdService).UpdateCdScript(MustCdScript(NewSystemdCdScriptBuilder().Pipeline(nil).Build()))
+
+	deployment, err := getTestCdServer().Deploy(context.Background(), svc, "172.17.0.4")
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	result, err := deployment.Wait(context.Background())
+	t.Log(result, err)
+	if result != nil {
+		for _, stage := range result.Stages {
+			t.Log(stage.Name, stage.Status, stage.Duration)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	plan, err := getTestCdServer().DryRun(context.Background(), getTestCdService(), "172.17.0.4")
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	t.Log(plan.JobName, plan.DeployId, plan.Params)
+	t.Log(plan.Config)
+}
+
+func TestDeployParamsWithoutS3(t *testing.T) {
+	cdServer := &CdServer{env: "prod"}
+	svc := NewDockerCdService("runit", "nginx:latest", "-p 8080:80", "", map[string]string{"A": "1"})
+	params, err := cdServer.getDeployParams(svc, "20261019120000-a1b2c3d4", ACTION_DEPLOY, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := params["S3GET_URL"]; ok || params["RUN_ENV"] != "prod" {
+		t.Fatal(params)
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	script := NewSystemdCdScript()
+	params := map[string]string{"PKG_URL": "pkg.tgz", "TARGET_PATH": "/tmp/test", "RUN_CMD": "run.sh", "UNIT_NAME": "runit"}
+	if err := script.ValidateParams(params); err != nil {
+		t.Fatal(err)
+	}
+
+	invalids := []map[string]string{
+		{"PKG_URL": "pkg.tgz", "TARGET_PATH": "/tmp/test", "RUN_CMD": "run.sh", "UNIT_NAME": "runit", "RUN_USR": "www"},
+		{"PKG_URL": "pkg.tgz", "TARGET_PATH": "/tmp/test", "RUN_CMD": "run.sh"},
+		{"PKG_URL": "pkg.tgz", "TARGET_PATH": "/tmp/test", "RUN_CMD": "run.sh", "UNIT_NAME": "run it"},
+		{"PKG_URL": "pkg.tgz", "TARGET_PATH": "/tmp/test", "RUN_CMD": "run.sh", "UNIT_NAME": "runit", "ACTION": "reload"},
+	}
+	for _, invalid := range invalids {
+		if err := script.ValidateParams(invalid); !errors.Is(err, ErrInvalidParam) {
+			t.Fatal(invalid, err)
+		}
+	}
+
+	config, err := script.GetCdTaskScriptConfig("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "<hudson.model.PasswordParameterDefinition>\n          <name>S3ENV_VAR</name>") ||
+		!strings.Contains(config, "<string>deploy</string>") {
+		t.Fatal(config)
+	}
+
+	boolScript := MustCdScript(NewCdScript([]*CdScriptParamDef{{Name: "DRY_RUN", Type: PARAM_TYPE_BOOL, DefaultValue: "false"}}, DefaultXmlTpl, DefaultTaskScript, 0))
+	if err := boolScript.ValidateParams(map[string]string{"DRY_RUN": "yes"}); !errors.Is(err, ErrInvalidParam) {
+		t.Fatal(err)
+	}
+	if _, err := NewCdScript([]*CdScriptParamDef{{Name: "PORT", Pattern: "[0-9"}}, DefaultXmlTpl, DefaultTaskScript, 0); !errors.Is(err, ErrInvalidScript) {
+		t.Fatal("invalid pattern", err)
+	}
+}
+
+func TestParseServiceStatus(t *testing.T) {
+	markers := parseDeployMarkers("gocd:deploy:20261019120000-a1b2c3d4:status\ngocd:status:running:MainPID=123 ActiveEnterTimestamp=Mon 2026-10-19 12:00:00 UTC \ngocd:exit:0:1600000004000\n")
+	if markers.status == nil || markers.status.State != SERVICE_STATE_RUNNING || markers.status.Detail != "MainPID=123 ActiveEnterTimestamp=Mon 2026-10-19 12:00:00 UTC" {
+		t.Fatal(markers.status)
+	}
+
+	if _, err := (&CdServer{}).RunAction(context.Background(), getTestCdService(), "172.17.0.4", "reload"); !errors.Is(err, ErrUnsupportedAction) {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceActions(t *testing.T) {
+	jserver := getTestCdServer()
+	svc := NewSystemdCdService("runit", "pkg.tgz", "/tmp/test", "run.sh", "", map[string]string{"A": "1"})
+
+	result, err := jserver.Restart(context.Background(), svc, "172.17.0.4")
+	t.Log(result, err)
+
+	status, err := jserver.Status(context.Background(), svc, "172.17.0.4")
+	t.Log(status, err)
+
+	result, err = jserver.Stop(context.Background(), svc, "172.17.0.4")
+	t.Log(result, err)
+}
+
+func TestDeploySystemd(t *testing.T) {
+	svc := NewSystemdCdService("runit", "pkg.tgz", "/tmp/test", "run.sh", "", map[string]string{"A": "1"})
+	jobName, taskId, err := getTestCdServer().DeploySimple(context.Background(), svc, "172.17.0.4")
+	t.Log(jobName, taskId, err)
+}
+
+func TestCdScriptConfigHash(t *testing.T) {
+	cdScript := NewDefaultCdScript()
+	config, hash, err := cdScript.getCdTaskScriptConfigWithHash("127.0.0.1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "<description>"+configHashPrefix+hash+"</description>") {
+		t.Fatal(config)
+	}
+	config, _, _ = cdScript.getCdTaskScriptConfigWithHash("127.0.0.1", "prod", nil)
+	if !strings.Contains(config, "<description>"+configEnvPrefix+"prod "+configHashPrefix+hash+"</description>") {
+		t.Fatal(config)
+	}
+
+	_, hash2, _ := cdScript.getCdTaskScriptConfigWithHash("127.0.0.1", "", nil)
+	_, hash3, _ := cdScript.getCdTaskScriptConfigWithHash("127.0.0.2", "", nil)
+	changed := MustCdScript(NewCdScript(nil, DefaultXmlTpl, DefaultTaskScript+"\necho changed\n", defaultTaskScriptVer))
+	_, hash4, _ := changed.getCdTaskScriptConfigWithHash("127.0.0.1", "", nil)
+	if hash != hash2 || hash == hash3 || hash == hash4 {
+		t.Fatal(hash, hash2, hash3, hash4)
+	}
+}
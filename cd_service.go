@@ -2,6 +2,8 @@ package gocd
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 )
@@ -10,14 +12,16 @@ type CdService interface {
 	GetName() string              // service name 服务名
 	GetParams() map[string]string // invoke script dynamic params,see cdScript 传入脚本的动态参数与cdScript定义必须一致
 	GetCdScript() *CdScript       // deploy script  部署脚本
-	IncDeployCounter() uint32     // deploy counter 部署计数器，用于并发部署和计数
+
+	//Deprecated: 部署时按执行器空闲状态选择job，计数器只在部署提交成功后累加，不再用于选择job
+	IncDeployCounter() uint32 // deploy counter 部署计数器
 }
 
 type DefaultCdService struct {
 	name          string            // service name 服务名
 	params        map[string]string // invoke script dynamic params,see cdScript 传入脚本的动态参数与cdScript定义必须一致
 	cdScript      *CdScript         // deploy script  部署脚本
-	deployCounter uint32            // deploy counter 部署计数器，用于并发部署和计数
+	deployCounter uint32            // deploy counter 部署计数器
 }
 
 //程序运行配置中，抽提db信息放到环境变量中运行时传递
@@ -28,20 +32,13 @@ type DefaultCdService struct {
 //envVar     map[string]string // 动态参数-通过环境变量传递
 
 func NewDefaultCdService(name, pkgUrl, targetPath, runCmd string, envVar map[string]string) CdService {
-	var envsStr strings.Builder
-	if envVar != nil {
-		for key, value := range envVar {
-			envsStr.WriteString(fmt.Sprintf(" %v=%v", key, value))
-		}
-	}
-
 	cdService := &DefaultCdService{
 		name: name,
 		params: map[string]string{
 			"PKG_URL":     pkgUrl, //s3get download package
 			"TARGET_PATH": targetPath,
 			"RUN_CMD":     runCmd,
-			"ENV_VAR":     envsStr.String(),
+			"ENV_VAR":     formatEnvVar(envVar),
 		},
 		cdScript: NewDefaultCdScript(),
 	}
@@ -61,6 +58,7 @@ func (t *DefaultCdService) GetCdScript() *CdScript {
 	return t.cdScript
 }
 
+//Deprecated: 见CdService.IncDeployCounter
 func (t *DefaultCdService) IncDeployCounter() uint32 {
 	return atomic.AddUint32(&t.deployCounter, 1)
 }
@@ -69,3 +67,33 @@ func (t *DefaultCdService) IncDeployCounter() uint32 {
 func (t *DefaultCdService) UpdatePkgUrl(pkgUrl string) {
 	t.params["PKG_URL"] = pkgUrl
 }
+
+//是否执行程序包中的gocd/pre_install.sh、post_install.sh、pre_start.sh，默认执行
+func (t *DefaultCdService) UpdateHooksEnabled(enabled bool) {
+	t.params["HOOKS_ENABLED"] = fmt.Sprint(enabled)
+}
+
+//部署时保留的版本数，默认5个
+func (t *DefaultCdService) UpdateKeepReleases(keepReleases int) {
+	t.params["KEEP_RELEASES"] = strconv.Itoa(keepReleases)
+}
+
+//替换部署脚本，如使用CdScriptBuilder调整阶段后Build的脚本
+func (t *DefaultCdService) UpdateCdScript(cdScript *CdScript) {
+	t.cdScript = cdScript
+}
+
+//环境变量按key排序拼接为 " k1=v1 k2=v2"，脚本中export ${ENV_VAR}
+func formatEnvVar(envVar map[string]string) string {
+	keys := make([]string, 0, len(envVar))
+	for key := range envVar {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var envsStr strings.Builder
+	for _, key := range keys {
+		envsStr.WriteString(fmt.Sprintf(" %v=%v", key, envVar[key]))
+	}
+	return envsStr.String()
+}
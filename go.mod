@@ -6,4 +6,5 @@ require (
 	github.com/aws/aws-sdk-go v1.42.23
 	github.com/liumingmin/gojenkins v1.1.8
 	github.com/liumingmin/goutils v1.0.15
+	gopkg.in/yaml.v2 v2.4.0
 )